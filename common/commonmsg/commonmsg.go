@@ -130,6 +130,11 @@ type DownLoadFileCmdMsg struct {
 	DownloadType     string `json:"downloadType"`
 	OriginRegion     string `json:"originRegion"`
 	//TargetRegion     string `json:"targetRegion"`
+	ExpectedSize int64    `json:"expectedSize"`
+	ExpectedHash string   `json:"expectedHash"`
+	HashType     string   `json:"hashType"`  // md5 or sha256
+	HashBytes    int64    `json:"hashBytes"` // hash only the first bytes like utils.HashLocalFile, 0 means whole file
+	Sources      []string `json:"sources"`   // fallback urls tried in order after downloadurl, like terminals holding the file
 	SignMsg
 }
 
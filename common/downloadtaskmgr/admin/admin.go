@@ -0,0 +1,239 @@
+// Package admin is the local http api to inspect and control a download manager
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/daqnext/meson-common/common/downloadtaskmgr"
+	"github.com/daqnext/meson-common/common/ginrouter"
+	"github.com/daqnext/meson-common/common/resp"
+	"github.com/gin-gonic/gin"
+)
+
+type AddTaskMsg struct {
+	TargetUrl    string                       `json:"targetUrl" binding:"required"`
+	SavePath     string                       `json:"savePath" binding:"required"`
+	BindName     string                       `json:"bindname"`
+	FileName     string                       `json:"filename"`
+	Continent    string                       `json:"continent"`
+	Country      string                       `json:"country"`
+	Area         string                       `json:"area"`
+	DownloadType string                       `json:"downloadType"`
+	OriginRegion string                       `json:"originRegion"`
+	TargetRegion string                       `json:"targetRegion"`
+	ExpectedSize int64                        `json:"expectedSize"`
+	ExpectedHash string                       `json:"expectedHash"`
+	HashType     string                       `json:"hashType"`
+	HashBytes    int64                        `json:"hashBytes"`
+	MaxSpeedKBs  int64                        `json:"maxSpeedKBs"`
+	Priority     downloadtaskmgr.TaskPriority `json:"priority"`
+	Sources      []string                     `json:"sources"`
+	NotBefore    int64                        `json:"notBefore"`
+	Deadline     int64                        `json:"deadline"`
+}
+
+// SpeedLimitMsg nil field is not changed, 0 means unlimited
+type SpeedLimitMsg struct {
+	MaxSpeedKBs        *int64 `json:"maxSpeedKBs"`
+	NewTaskMaxSpeedKBs *int64 `json:"newTaskMaxSpeedKBs"`
+}
+
+// Options access control of the api, the router may serve public traffic as well
+type Options struct {
+	Token     string   //required in header "Authorization: Bearer <Token>", empty means only loopback requests are allowed
+	RootPaths []string //POST /task only saves files under these absolute folders, empty means no task can be added
+}
+
+// Mount add the api under relativePath of router, like "/api/download"
+func Mount(router *ginrouter.GinAutoRouter, relativePath string, m *downloadtaskmgr.Manager, opts Options) *gin.RouterGroup {
+	group := router.GinInstance.Group(relativePath)
+	Register(group, m, opts)
+	return group
+}
+
+// access reject requests without the token, or not from loopback if no token is set
+func (o Options) access(c *gin.Context) {
+	if o.Token == "" {
+		host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !ip.IsLoopback() {
+			resp.ErrorResp(c, resp.ErrUserForbidden)
+			c.Abort()
+		}
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(o.Token)) != 1 {
+		resp.ErrorResp(c, resp.ErrUserUnAuth)
+		c.Abort()
+	}
+}
+
+// allowedPath savePath must be inside one of RootPaths after cleaned
+func (o Options) allowedPath(savePath string) bool {
+	if !filepath.IsAbs(savePath) {
+		return false
+	}
+	savePath = filepath.Clean(savePath)
+	for _, root := range o.RootPaths {
+		rel, err := filepath.Rel(filepath.Clean(root), savePath)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Register add the api into group, every request is checked by opts
+//
+//	GET  /tasks?state=queued|idle|running|processing|waiting|scheduled|paused
+//	GET  /channels
+//	POST /task              savePath must be under Options.RootPaths
+//	POST /task/:id/cancel
+//	POST /task/:id/retry   paused, waiting for retry or recently failed task
+//	POST /limit
+//	POST /channel/:index/limit
+func Register(group *gin.RouterGroup, m *downloadtaskmgr.Manager, opts Options) {
+	group.Use(opts.access)
+
+	group.GET("/tasks", func(c *gin.Context) {
+		state := downloadtaskmgr.TaskState(c.Query("state"))
+		list := []downloadtaskmgr.TaskSummary{}
+		for _, v := range m.ListTasks() {
+			if state == "" || v.State == state {
+				list = append(list, v)
+			}
+		}
+		resp.SuccessResp(c, list)
+	})
+
+	group.GET("/channels", func(c *gin.Context) {
+		resp.SuccessResp(c, m.GetOccupancy())
+	})
+
+	group.POST("/task", func(c *gin.Context) {
+		var msg AddTaskMsg
+		if err := c.ShouldBindJSON(&msg); err != nil {
+			resp.ErrorResp(c, resp.ErrMalParams)
+			return
+		}
+		if !opts.allowedPath(msg.SavePath) {
+			resp.ErrorResp(c, resp.ErrFileNameError)
+			return
+		}
+		id, err := m.AddTask(&downloadtaskmgr.DownloadInfo{
+			TargetUrl:    msg.TargetUrl,
+			BindName:     msg.BindName,
+			FileName:     msg.FileName,
+			Continent:    msg.Continent,
+			Country:      msg.Country,
+			Area:         msg.Area,
+			SavePath:     filepath.Clean(msg.SavePath),
+			DownloadType: msg.DownloadType,
+			OriginRegion: msg.OriginRegion,
+			TargetRegion: msg.TargetRegion,
+			ExpectedSize: msg.ExpectedSize,
+			ExpectedHash: msg.ExpectedHash,
+			HashType:     msg.HashType,
+			HashBytes:    msg.HashBytes,
+			MaxSpeedKBs:  msg.MaxSpeedKBs,
+			Priority:     msg.Priority,
+			Sources:      msg.Sources,
+			NotBefore:    msg.NotBefore,
+			Deadline:     msg.Deadline,
+		})
+		if err != nil {
+			errorResp(c, err)
+			return
+		}
+		resp.SuccessResp(c, gin.H{"id": id})
+	})
+
+	group.POST("/task/:id/cancel", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			resp.ErrorResp(c, resp.ErrMalParams)
+			return
+		}
+		err = m.CancelTask(id)
+		if err != nil {
+			errorResp(c, err)
+			return
+		}
+		resp.SuccessResp(c, nil)
+	})
+
+	group.POST("/task/:id/retry", func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			resp.ErrorResp(c, resp.ErrMalParams)
+			return
+		}
+		err = m.RetryTask(id)
+		if err != nil {
+			errorResp(c, err)
+			return
+		}
+		resp.SuccessResp(c, nil)
+	})
+
+	group.POST("/limit", func(c *gin.Context) {
+		var msg SpeedLimitMsg
+		if err := c.ShouldBindJSON(&msg); err != nil {
+			resp.ErrorResp(c, resp.ErrMalParams)
+			return
+		}
+		if msg.MaxSpeedKBs != nil {
+			m.SetMaxSpeed(*msg.MaxSpeedKBs)
+		}
+		if msg.NewTaskMaxSpeedKBs != nil {
+			m.SetNewTaskMaxSpeed(*msg.NewTaskMaxSpeedKBs)
+		}
+		resp.SuccessResp(c, m.GetOccupancy())
+	})
+
+	group.POST("/channel/:index/limit", func(c *gin.Context) {
+		index, err := strconv.Atoi(c.Param("index"))
+		var msg SpeedLimitMsg
+		if err == nil {
+			err = c.ShouldBindJSON(&msg)
+		}
+		if err != nil || msg.MaxSpeedKBs == nil {
+			resp.ErrorResp(c, resp.ErrMalParams)
+			return
+		}
+		err = m.SetChannelMaxSpeed(index, *msg.MaxSpeedKBs)
+		if err != nil {
+			resp.ErrorResp(c, resp.ErrMalParams)
+			return
+		}
+		resp.SuccessResp(c, m.GetOccupancy())
+	})
+}
+
+func errorResp(c *gin.Context, err error) {
+	switch {
+	case err == downloadtaskmgr.ErrTaskNotExist:
+		resp.ErrorResp(c, resp.ErrDownloadTaskNotExist)
+	case errors.Is(err, downloadtaskmgr.ErrTaskExist):
+		resp.ErrorResp(c, resp.ErrDownloadTaskExist)
+	case err == downloadtaskmgr.ErrQueueFull:
+		resp.ErrorResp(c, resp.ErrDownloadQueueFull)
+	case err == downloadtaskmgr.ErrTaskCancelled || err == downloadtaskmgr.ErrManagerClosed:
+		resp.ErrorResp(c, resp.ErrDownloadTaskStopped)
+	case err == downloadtaskmgr.ErrTaskRunning:
+		resp.ErrorResp(c, resp.ErrDownloadTaskRunning)
+	case err == downloadtaskmgr.ErrTaskExpired:
+		resp.ErrorResp(c, resp.ErrMalParams)
+	case err == resp.ErrNoSpace:
+		resp.ErrorResp(c, resp.ErrNoSpace)
+	default:
+		resp.ErrorResp(c, resp.ErrAddDownloadTaskFailed)
+	}
+}
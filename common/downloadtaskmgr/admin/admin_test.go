@@ -0,0 +1,150 @@
+package admin_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/daqnext/meson-common/common/downloadtaskmgr"
+	"github.com/daqnext/meson-common/common/downloadtaskmgr/admin"
+	"github.com/daqnext/meson-common/common/downloadtaskmgr/dltest"
+	"github.com/daqnext/meson-common/common/resp"
+	"github.com/gin-gonic/gin"
+)
+
+type testApi struct {
+	t      *testing.T
+	router *gin.Engine
+}
+
+func newTestApi(t *testing.T, opts admin.Options) (*testApi, *downloadtaskmgr.Manager, *dltest.Origin, string) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := dltest.NewOrigin()
+	m := downloadtaskmgr.NewManager(dltest.Config(dir, dltest.NewFakeClock(time.Unix(1600000000, 0))))
+	err = m.Init(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Run()
+	t.Cleanup(func() {
+		origin.Release()
+		m.Shutdown(context.Background())
+		origin.Close()
+		os.RemoveAll(dir)
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	if opts.RootPaths == nil {
+		opts.RootPaths = []string{filepath.Join(dir, "files")}
+	}
+	admin.Register(router.Group("/api/download"), m, opts)
+	return &testApi{t: t, router: router}, m, origin, dir
+}
+
+// do request from remoteAddr and return the status in response body
+func (a *testApi) do(remoteAddr string, token string, method string, path string, body interface{}) (int, json.RawMessage) {
+	content, err := json.Marshal(body)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	req := httptest.NewRequest(method, "/api/download"+path, bytes.NewReader(content))
+	req.RemoteAddr = remoteAddr
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		a.t.Fatal(method, path, w.Code)
+	}
+	result := struct {
+		Status int             `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &result)
+	if err != nil {
+		a.t.Fatal(method, path, err, w.Body.String())
+	}
+	return result.Status, result.Data
+}
+
+const local = "127.0.0.1:40000"
+const remote = "10.0.0.1:40000"
+
+func TestAccess(t *testing.T) {
+	api, _, _, _ := newTestApi(t, admin.Options{})
+	if status, _ := api.do(local, "", http.MethodGet, "/tasks", nil); status != 0 {
+		t.Fatal("loopback", status)
+	}
+	if status, _ := api.do(remote, "", http.MethodGet, "/tasks", nil); status != int(resp.ErrUserForbidden.Code()) {
+		t.Fatal("remote", status)
+	}
+
+	api, _, _, _ = newTestApi(t, admin.Options{Token: "secret"})
+	for _, token := range []string{"", "wrong"} {
+		if status, _ := api.do(local, token, http.MethodGet, "/channels", nil); status != int(resp.ErrUserUnAuth.Code()) {
+			t.Fatal("token", token, status)
+		}
+	}
+	if status, _ := api.do(remote, "secret", http.MethodGet, "/channels", nil); status != 0 {
+		t.Fatal("remote with token", status)
+	}
+}
+
+func TestTask(t *testing.T) {
+	api, m, origin, dir := newTestApi(t, admin.Options{})
+	sub := m.Subscribe(1024)
+	defer sub.Close()
+	data := dltest.RandomData(10 * 1000)
+	url := origin.Add("file", dltest.File{Data: data})
+
+	//files are only saved under root paths
+	for _, savePath := range []string{"", "file", filepath.Join(dir, "files"), filepath.Join(dir, "files", "..", "db", "file"), "/etc/file"} {
+		status, _ := api.do(local, "", http.MethodPost, "/task", admin.AddTaskMsg{TargetUrl: url, SavePath: savePath})
+		if status != int(resp.ErrMalParams.Code()) && status != int(resp.ErrFileNameError.Code()) {
+			t.Fatal("save path", savePath, status)
+		}
+	}
+
+	savePath := filepath.Join(dir, "files", "sub", "..", "file")
+	status, body := api.do(local, "", http.MethodPost, "/task", admin.AddTaskMsg{TargetUrl: url, SavePath: savePath})
+	if status != 0 {
+		t.Fatal("add", status)
+	}
+	added := struct {
+		Id uint64 `json:"id"`
+	}{}
+	err := json.Unmarshal(body, &added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := dltest.WaitEvent(sub, 10*time.Second, dltest.IsEvent(added.Id, downloadtaskmgr.Event_Succeeded))
+	if !ok {
+		t.Fatal("not succeeded")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "files", "file"))
+	if err != nil || !bytes.Equal(content, data) {
+		t.Fatal("file", err)
+	}
+
+	if status, _ := api.do(local, "", http.MethodPost, "/task/9/cancel", nil); status != int(resp.ErrDownloadTaskNotExist.Code()) {
+		t.Fatal("cancel", status)
+	}
+	if status, _ := api.do(local, "", http.MethodPost, "/task/x/retry", nil); status != int(resp.ErrMalParams.Code()) {
+		t.Fatal("retry", status)
+	}
+	if status, _ := api.do(local, "", http.MethodPost, "/channel/0/limit", admin.SpeedLimitMsg{}); status != int(resp.ErrMalParams.Code()) {
+		t.Fatal("channel limit", status)
+	}
+}
@@ -0,0 +1,56 @@
+package downloadtaskmgr
+
+import (
+	"time"
+)
+
+// ScanInterval how often LoopScanRunningTask and breakSlowSources run
+const ScanInterval = 5 * time.Second
+
+// SpeedInterval how often the speed of running task is updated
+const SpeedInterval = time.Second
+
+// Clock time source of the scan loop, speed monitor and retry timers.
+// Tests replace it to drive them without waiting, see package dltest.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type Timer interface {
+	// Stop return false if the function already started
+	Stop() bool
+}
+
+// RealClock is the default Clock
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{ticker: time.NewTicker(d)}
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
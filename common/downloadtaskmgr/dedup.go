@@ -0,0 +1,133 @@
+package downloadtaskmgr
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ErrTaskExist is matched by errors.Is for every TaskExistError
+var ErrTaskExist = errors.New("task already queued")
+
+// TaskExistError a queued or running task already downloads the same SavePath or TargetUrl
+type TaskExistError struct {
+	TaskId uint64
+}
+
+func (e *TaskExistError) Error() string {
+	return ErrTaskExist.Error() + ", id " + strconv.FormatUint(e.TaskId, 10)
+}
+
+func (e *TaskExistError) Is(target error) bool {
+	return target == ErrTaskExist
+}
+
+// TaskDoneCallback is called once when the task succeeds, fails or is cancelled
+type TaskDoneCallback func(task *DownloadTask, success bool)
+
+// dedupKeys same SavePath always means same task, same TargetUrl only if Config.DedupByTargetUrl
+func (m *Manager) dedupKeys(info *DownloadInfo) []string {
+	keys := []string{}
+	if info.SavePath != "" {
+		keys = append(keys, "path:"+absPath(info.SavePath))
+	}
+	if m.config.DedupByTargetUrl && info.TargetUrl != "" {
+		keys = append(keys, "url:"+info.TargetUrl)
+	}
+	return keys
+}
+
+func (m *Manager) findDuplicateLocked(info *DownloadInfo) (uint64, bool) {
+	for _, key := range m.dedupKeys(info) {
+		id, exist := m.dedupIndex[key]
+		if exist {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// indexTasks add tasks into dedup index, nothing is added if any of them is duplicated
+func (m *Manager) indexTasks(tasks []*DownloadTask, onDone TaskDoneCallback) error {
+	m.dedupLock.Lock()
+	defer m.dedupLock.Unlock()
+	batch := map[string]uint64{}
+	for _, v := range tasks {
+		id, exist := m.findDuplicateLocked(&v.DownloadInfo)
+		if exist {
+			return &TaskExistError{TaskId: id}
+		}
+		for _, key := range m.dedupKeys(&v.DownloadInfo) {
+			id, exist := batch[key]
+			if exist {
+				return &TaskExistError{TaskId: id}
+			}
+			batch[key] = v.Id
+		}
+	}
+
+	for key, id := range batch {
+		m.dedupIndex[key] = id
+	}
+	if onDone != nil {
+		for _, v := range tasks {
+			m.doneCallbacks[v.Id] = append(m.doneCallbacks[v.Id], onDone)
+		}
+	}
+	return nil
+}
+
+// unindexTask remove task from dedup index and return its callbacks
+func (m *Manager) unindexTask(task *DownloadTask) []TaskDoneCallback {
+	m.dedupLock.Lock()
+	defer m.dedupLock.Unlock()
+	for _, key := range m.dedupKeys(&task.DownloadInfo) {
+		if m.dedupIndex[key] == task.Id {
+			delete(m.dedupIndex, key)
+		}
+	}
+	callbacks := m.doneCallbacks[task.Id]
+	delete(m.doneCallbacks, task.Id)
+	return callbacks
+}
+
+// finishTask the same file can be queued again after this
+func (m *Manager) finishTask(task *DownloadTask, success bool) {
+	callbacks := m.unindexTask(task)
+	if len(callbacks) == 0 {
+		return
+	}
+	runDoneCallbacks(m.snapshotTask(task), callbacks, success)
+}
+
+func runDoneCallbacks(snapshot *DownloadTask, callbacks []TaskDoneCallback, success bool) {
+	for _, v := range callbacks {
+		v(snapshot, success)
+	}
+}
+
+// AddOrAttachTask add a new task, or attach onDone to the task which already downloads the same file.
+// It returns the id of the task which onDone is attached to.
+func (m *Manager) AddOrAttachTask(info *DownloadInfo, onDone TaskDoneCallback) (uint64, error) {
+	for {
+		m.dedupLock.Lock()
+		id, exist := m.findDuplicateLocked(info)
+		if exist {
+			if onDone != nil {
+				m.doneCallbacks[id] = append(m.doneCallbacks[id], onDone)
+			}
+			m.dedupLock.Unlock()
+			return id, nil
+		}
+		m.dedupLock.Unlock()
+
+		ids, err := m.addTasks([]*DownloadInfo{info}, onDone)
+		//added by others just now, attach to it
+		if errors.Is(err, ErrTaskExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return ids[0], nil
+	}
+}
@@ -0,0 +1,243 @@
+package downloadtaskmgr
+
+import (
+	"context"
+	"sync"
+
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+// package level functions work on the default manager
+
+// DownloadingTaskMap running tasks of the default manager, task id to *DownloadTask.
+//
+// Deprecated: tasks in it are changed by download without lock, use GetDownloadTaskList or ListTasks.
+var DownloadingTaskMap sync.Map
+
+var defaultManager = newDefaultManager()
+
+func newDefaultManager() *Manager {
+	m := NewManager(DefaultConfig())
+	//running tasks are still seen through the package level map
+	m.downloadingTaskMap = &DownloadingTaskMap
+	return m
+}
+
+func DefaultManager() *Manager {
+	return defaultManager
+}
+
+func InitTaskMgr(rootPath string) error {
+	//LDBPath may be changed before init
+	defaultManager.config.DBPath = LDBPath
+	//the default manager owns rootPath, stale temp files are its own
+	defaultManager.config.CleanTempFiles = true
+	return defaultManager.Init(rootPath)
+}
+
+func Run() {
+	defaultManager.Run()
+}
+
+func Shutdown(ctx context.Context) error {
+	return defaultManager.Shutdown(ctx)
+}
+
+func AddGlobalDownloadTask(info *DownloadInfo) error {
+	return defaultManager.AddGlobalDownloadTask(info)
+}
+
+func AddGlobalDownloadTasks(infos []*DownloadInfo) error {
+	return defaultManager.AddGlobalDownloadTasks(infos)
+}
+
+func AddTask(info *DownloadInfo) (uint64, error) {
+	return defaultManager.AddTask(info)
+}
+
+func AddOrAttachTask(info *DownloadInfo, onDone TaskDoneCallback) (uint64, error) {
+	return defaultManager.AddOrAttachTask(info, onDone)
+}
+
+func SetPanicCatcher(function func()) {
+	defaultManager.SetPanicCatcher(function)
+}
+
+func SetOnTaskSuccess(function func(task *DownloadTask)) {
+	defaultManager.SetOnTaskSuccess(function)
+}
+
+func SetOnTaskFailed(function func(task *DownloadTask)) {
+	defaultManager.SetOnTaskFailed(function)
+}
+
+func SetOnDownloading(function func(task *DownloadTask, usedTimeSec int)) {
+	defaultManager.SetOnDownloading(function)
+}
+
+func SetOnDownloadStart(function func(task *DownloadTask)) {
+	defaultManager.SetOnDownloadStart(function)
+}
+
+func GetDownloadTaskList() []*DownloadTask {
+	return defaultManager.GetDownloadTaskList()
+}
+
+func AddTaskToDownloadingMap(task *DownloadTask) {
+	defaultManager.AddTaskToDownloadingMap(task)
+}
+
+func DeleteDownloadingTask(taskid uint64) {
+	defaultManager.DeleteDownloadingTask(taskid)
+}
+
+func LoopScanRunningTask() {
+	defaultManager.LoopScanRunningTask()
+}
+
+func SetEvictionPolicy(policy EvictionPolicy) {
+	defaultManager.SetEvictionPolicy(policy)
+}
+
+func SetPostProcessors(processors []PostProcessor) {
+	defaultManager.SetPostProcessors(processors)
+}
+
+func TaskSuccess(task *DownloadTask) {
+	defaultManager.TaskSuccess(task)
+}
+
+func TaskFail(task *DownloadTask) {
+	defaultManager.TaskFail(task)
+}
+
+func TaskBreak(task *DownloadTask) {
+	defaultManager.TaskBreak(task)
+}
+
+func TaskRetry(task *DownloadTask) {
+	defaultManager.TaskRetry(task)
+}
+
+func TaskDefer(task *DownloadTask) {
+	defaultManager.TaskDefer(task)
+}
+
+func StartTask(task *DownloadTask) {
+	defaultManager.StartTask(task)
+}
+
+func RunChannelDownload() {
+	defaultManager.RunChannelDownload()
+}
+
+func RunNewTask() {
+	defaultManager.RunNewTask()
+}
+
+// ExecDownloadTask download the file once with the default manager, use DefaultManager().ExecDownloadTask to stop it by ctx
+func ExecDownloadTask(task *DownloadTask) ExecResult {
+	return defaultManager.ExecDownloadTask(context.Background(), task)
+}
+
+func SetTaskToLDB(task *DownloadTask) error {
+	return defaultManager.SetTaskToLDB(task)
+}
+
+func DelTaskFromLDB(taskId uint64) error {
+	return defaultManager.DelTaskFromLDB(taskId)
+}
+
+// LoopTasksInLDB return tasks saved by the default manager, nil on error, use DefaultManager().LoopTasksInLDB to get the error
+func LoopTasksInLDB() []*DownloadTask {
+	tasks, err := defaultManager.LoopTasksInLDB()
+	if err != nil {
+		logger.Error("LoopTasksInDB error", "err", err)
+		return nil
+	}
+	return tasks
+}
+
+func CloseLDB() error {
+	return defaultManager.CloseLDB()
+}
+
+func GetTask(id uint64) *DownloadTask {
+	return defaultManager.GetTask(id)
+}
+
+func CancelTask(id uint64) error {
+	return defaultManager.CancelTask(id)
+}
+
+func CancelTaskByFile(bindName string, fileName string) int {
+	return defaultManager.CancelTaskByFile(bindName, fileName)
+}
+
+func PauseTask(id uint64) error {
+	return defaultManager.PauseTask(id)
+}
+
+func ResumeTask(id uint64) error {
+	return defaultManager.ResumeTask(id)
+}
+
+func RetryTask(id uint64) error {
+	return defaultManager.RetryTask(id)
+}
+
+func SetMaxSpeed(kbs int64) {
+	defaultManager.SetMaxSpeed(kbs)
+}
+
+func SetBandwidthSchedule(schedule *BandwidthSchedule) {
+	defaultManager.SetBandwidthSchedule(schedule)
+}
+
+func SetNewTaskMaxSpeed(kbs int64) {
+	defaultManager.SetNewTaskMaxSpeed(kbs)
+}
+
+func SetChannelMaxSpeed(channelIndex int, kbs int64) error {
+	return defaultManager.SetChannelMaxSpeed(channelIndex, kbs)
+}
+
+func SetTaskMaxSpeed(id uint64, kbs int64) error {
+	return defaultManager.SetTaskMaxSpeed(id, kbs)
+}
+
+func SetHostLimit(limit HostLimit) {
+	defaultManager.SetHostLimit(limit)
+}
+
+func SetBindNameHostLimit(bindName string, limit HostLimit) {
+	defaultManager.SetBindNameHostLimit(bindName, limit)
+}
+
+func RemoveBindNameHostLimit(bindName string) {
+	defaultManager.RemoveBindNameHostLimit(bindName)
+}
+
+func SetTransportConfig(config TransportConfig) error {
+	return defaultManager.SetTransportConfig(config)
+}
+
+func GetDiskSpace(path string) (DiskSpace, error) {
+	return defaultManager.GetDiskSpace(path)
+}
+
+func SpaceReservations() []SpaceReservation {
+	return defaultManager.SpaceReservations()
+}
+
+func Subscribe(bufferSize int) *Subscription {
+	return defaultManager.Subscribe(bufferSize)
+}
+
+func ListTasks() []TaskSummary {
+	return defaultManager.ListTasks()
+}
+
+func GetOccupancy() Occupancy {
+	return defaultManager.GetOccupancy()
+}
@@ -0,0 +1,162 @@
+package downloadtaskmgr
+
+import (
+	"path/filepath"
+
+	"github.com/daqnext/meson-common/common/logger"
+	"github.com/daqnext/meson-common/common/resp"
+	"github.com/daqnext/meson-common/common/utils"
+)
+
+// ErrNoSpace same as resp.ErrNoSpace, http handlers can return it directly
+var ErrNoSpace = resp.ErrNoSpace
+
+const FailReason_NoSpace FailReason = "no_space"
+
+type diskInfo struct {
+	id    string //tasks on the same filesystem share its space
+	total uint64
+	free  uint64
+}
+
+// DiskSpace of the filesystem, Available is what is left after reservations and Config.MinFreeSpace,
+// it can be reported as CdnDiskAvailable of terminal
+type DiskSpace struct {
+	Total     uint64
+	Free      uint64
+	Reserved  uint64
+	Available uint64
+}
+
+type SpaceReservation struct {
+	TaskId   uint64
+	SavePath string
+	Bytes    uint64 //bytes still to be written
+}
+
+// spaceReservation sizes are copied from task, it is updated by setProgress so spaceLock is enough to read it
+type spaceReservation struct {
+	savePath   string
+	diskId     string
+	fileSize   int64
+	downloaded int64
+}
+
+func (r *spaceReservation) remain() uint64 {
+	remain := r.fileSize - r.downloaded
+	if remain < 0 {
+		return 0
+	}
+	return uint64(remain)
+}
+
+// existingDir statfs need an existing path, folder of SavePath may not be created yet
+func existingDir(p string) string {
+	dir := absPath(p)
+	for !utils.Exists(dir) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return dir
+}
+
+func (m *Manager) reservedLocked(diskId string) uint64 {
+	reserved := uint64(0)
+	for _, v := range m.reservations {
+		if v.diskId == diskId {
+			reserved += v.remain()
+		}
+	}
+	return reserved
+}
+
+func (m *Manager) enoughSpace(info diskInfo, reserved uint64, need uint64) bool {
+	return info.free >= reserved+need+m.config.MinFreeSpace
+}
+
+// checkSpace is used when task is added, nothing is reserved until it starts
+func (m *Manager) checkSpace(info *DownloadInfo) error {
+	if info.ExpectedSize <= 0 || info.SavePath == "" {
+		return nil
+	}
+	disk, err := diskUsage(existingDir(filepath.Dir(info.SavePath)))
+	if err != nil {
+		return nil
+	}
+	m.spaceLock.Lock()
+	defer m.spaceLock.Unlock()
+	if !m.enoughSpace(disk, m.reservedLocked(disk.id), uint64(info.ExpectedSize)) {
+		return ErrNoSpace
+	}
+	return nil
+}
+
+// reserveSpace reserve the rest of file on filesystem of SavePath before download,
+// return ErrNoSpace if Config.MinFreeSpace would be crossed
+func (m *Manager) reserveSpace(task *DownloadTask) error {
+	dir := existingDir(filepath.Dir(task.SavePath))
+	disk, err := diskUsage(dir)
+	if err != nil {
+		//can not tell, do not block the download
+		logger.Error("get disk usage error", "err", err, "path", dir)
+		return nil
+	}
+
+	m.taskLock.Lock()
+	r := &spaceReservation{savePath: task.SavePath, diskId: disk.id, fileSize: task.FileSize, downloaded: task.DownloadedSize}
+	m.taskLock.Unlock()
+	m.spaceLock.Lock()
+	defer m.spaceLock.Unlock()
+	if !m.enoughSpace(disk, m.reservedLocked(disk.id), r.remain()) {
+		return ErrNoSpace
+	}
+	m.reservations[task.Id] = r
+	return nil
+}
+
+// updateSpace is called with new downloaded size of task
+func (m *Manager) updateSpace(taskId uint64, downloaded int64) {
+	m.spaceLock.Lock()
+	defer m.spaceLock.Unlock()
+	r, exist := m.reservations[taskId]
+	if exist {
+		r.downloaded = downloaded
+	}
+}
+
+func (m *Manager) releaseSpace(taskId uint64) {
+	m.spaceLock.Lock()
+	defer m.spaceLock.Unlock()
+	delete(m.reservations, taskId)
+}
+
+// GetDiskSpace space of the filesystem which path is on
+func (m *Manager) GetDiskSpace(path string) (DiskSpace, error) {
+	disk, err := diskUsage(existingDir(path))
+	if err != nil {
+		return DiskSpace{}, err
+	}
+	m.spaceLock.Lock()
+	reserved := m.reservedLocked(disk.id)
+	m.spaceLock.Unlock()
+
+	space := DiskSpace{Total: disk.total, Free: disk.free, Reserved: reserved}
+	if disk.free > reserved+m.config.MinFreeSpace {
+		space.Available = disk.free - reserved - m.config.MinFreeSpace
+	}
+	return space, nil
+}
+
+// SpaceReservations reservations of running tasks
+func (m *Manager) SpaceReservations() []SpaceReservation {
+	m.spaceLock.Lock()
+	defer m.spaceLock.Unlock()
+	list := []SpaceReservation{}
+	for id, v := range m.reservations {
+		list = append(list, SpaceReservation{TaskId: id, SavePath: v.savePath, Bytes: v.remain()})
+	}
+	return list
+}
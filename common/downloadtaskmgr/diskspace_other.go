@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package downloadtaskmgr
+
+import (
+	"errors"
+)
+
+func diskUsage(path string) (diskInfo, error) {
+	return diskInfo{}, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package downloadtaskmgr
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func diskUsage(path string) (diskInfo, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(path, &st)
+	if err != nil {
+		return diskInfo{}, err
+	}
+	return diskInfo{
+		id:    fmt.Sprint(st.Fsid),
+		total: uint64(st.Blocks) * uint64(st.Bsize),
+		free:  uint64(st.Bavail) * uint64(st.Bsize),
+	}, nil
+}
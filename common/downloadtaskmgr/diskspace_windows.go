@@ -0,0 +1,35 @@
+//go:build windows
+// +build windows
+
+package downloadtaskmgr
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func diskUsage(path string) (diskInfo, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return diskInfo{}, err
+	}
+	var free, total, totalFree uint64
+	r, _, err := procGetDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&free)),
+		uintptr(unsafe.Pointer(&total)),
+		uintptr(unsafe.Pointer(&totalFree)),
+	)
+	if r == 0 {
+		return diskInfo{}, err
+	}
+	return diskInfo{
+		id:    strings.ToUpper(filepath.VolumeName(path)),
+		total: total,
+		free:  free,
+	}, nil
+}
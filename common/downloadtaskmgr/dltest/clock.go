@@ -0,0 +1,186 @@
+// Package dltest helps to test code using downloadtaskmgr: a fake origin server and a fake clock
+package dltest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daqnext/meson-common/common/downloadtaskmgr"
+)
+
+// FakeClock only moves by Advance, tickers and timers fire when time passes them
+type FakeClock struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	tickers map[*fakeTicker]struct{}
+	timers  map[*fakeTimer]struct{}
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	c := &FakeClock{
+		now:     start,
+		tickers: map[*fakeTicker]struct{}{},
+		timers:  map[*fakeTimer]struct{}{},
+	}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) downloadtaskmgr.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTicker{clock: c, period: d, next: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.tickers[t] = struct{}{}
+	c.cond.Broadcast()
+	return t
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) downloadtaskmgr.Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	c.timers[t] = struct{}{}
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance move time forward step by step, every ticker fires once at most in a step like time.Ticker drops ticks
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	for {
+		next, exist := c.nextEventLocked()
+		if !exist || next.After(end) {
+			break
+		}
+		c.now = next
+		c.fireLocked()
+	}
+	c.now = end
+	c.lock.Unlock()
+}
+
+// Tickers count of running tickers
+func (c *FakeClock) Tickers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.tickers)
+}
+
+// Timers count of timers not fired or stopped
+func (c *FakeClock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.timers)
+}
+
+// WaitTickers block until at least n tickers are running or timeout, return false if timeout.
+// The goroutine of scan loop or speed monitor must create its ticker before Advance, otherwise the tick is missed.
+func (c *FakeClock) WaitTickers(n int, timeout time.Duration) bool {
+	return c.wait(func() bool { return len(c.tickers) >= n }, timeout)
+}
+
+// WaitTimers block until at least n timers are waiting or timeout, return false if timeout
+func (c *FakeClock) WaitTimers(n int, timeout time.Duration) bool {
+	return c.wait(func() bool { return len(c.timers) >= n }, timeout)
+}
+
+func (c *FakeClock) wait(ok func() bool, timeout time.Duration) bool {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		c.lock.Lock()
+		expired = true
+		c.cond.Broadcast()
+		c.lock.Unlock()
+	})
+	defer timer.Stop()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for !ok() && !expired {
+		c.cond.Wait()
+	}
+	return ok()
+}
+
+func (c *FakeClock) nextEventLocked() (time.Time, bool) {
+	times := []time.Time{}
+	for t := range c.tickers {
+		times = append(times, t.next)
+	}
+	for t := range c.timers {
+		times = append(times, t.when)
+	}
+	if len(times) == 0 {
+		return time.Time{}, false
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times[0], true
+}
+
+func (c *FakeClock) fireLocked() {
+	for t := range c.tickers {
+		if t.next.After(c.now) {
+			continue
+		}
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+		for !t.next.After(c.now) {
+			t.next = t.next.Add(t.period)
+		}
+	}
+	for t := range c.timers {
+		if t.when.After(c.now) {
+			continue
+		}
+		delete(c.timers, t)
+		go t.f()
+	}
+	c.cond.Broadcast()
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	period time.Duration
+	next   time.Time
+	ch     chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	delete(t.clock.tickers, t)
+	t.clock.cond.Broadcast()
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	f     func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	_, waiting := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	t.clock.cond.Broadcast()
+	return waiting
+}
@@ -0,0 +1,45 @@
+package dltest
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/daqnext/meson-common/common/downloadtaskmgr"
+)
+
+// Config of a manager for tests, leveldb is in dir and retry backoff has no jitter
+func Config(dir string, clock downloadtaskmgr.Clock) downloadtaskmgr.Config {
+	config := downloadtaskmgr.DefaultConfig()
+	config.DBPath = filepath.Join(dir, "db")
+	config.Clock = clock
+	config.RetryPolicy.InitialBackoff = time.Second
+	config.RetryPolicy.MaxBackoff = 10 * time.Second
+	config.RetryPolicy.Jitter = 0
+	return config
+}
+
+// WaitEvent read events until match returns true, return false if timeout
+func WaitEvent(sub *downloadtaskmgr.Subscription, timeout time.Duration, match func(ev downloadtaskmgr.TaskEvent) bool) (downloadtaskmgr.TaskEvent, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.C:
+			if !ok {
+				return downloadtaskmgr.TaskEvent{}, false
+			}
+			if match(ev) {
+				return ev, true
+			}
+		case <-timer.C:
+			return downloadtaskmgr.TaskEvent{}, false
+		}
+	}
+}
+
+// IsEvent match event of the task
+func IsEvent(id uint64, eventType downloadtaskmgr.EventType) func(ev downloadtaskmgr.TaskEvent) bool {
+	return func(ev downloadtaskmgr.TaskEvent) bool {
+		return ev.Task.Id == id && ev.Type == eventType
+	}
+}
@@ -0,0 +1,255 @@
+package dltest
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File served by Origin
+type File struct {
+	Data         []byte
+	ETag         string    //empty means no ETag
+	LastModified time.Time //zero means no Last-Modified
+	NoRange      bool      //Range is ignored like origin without range support
+	ErrorStatus  int       //GET is answered with this status
+	ErrorTimes   int       //only the first ErrorTimes GET fail, 0 means all
+	BytesPerSec  int       //slow origin, 0 means unlimited
+	StallAfter   int64     //body stops at this position until Origin.Release or client gone, 0 means no stall
+	DeclaredSize int64     //size lying, Content-Length of whole file is this instead of len(Data), 0 means not lie
+}
+
+// Request received by Origin
+type Request struct {
+	Method string
+	Range  string
+}
+
+// Origin httptest server of files, it counts every request
+type Origin struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	files    map[string]*File
+	requests map[string][]Request
+	gets     map[string]int
+	release  chan struct{}
+	released bool
+	//GET being served at the same time
+	active    int
+	maxActive int
+}
+
+func NewOrigin() *Origin {
+	o := &Origin{
+		files:    map[string]*File{},
+		requests: map[string][]Request{},
+		gets:     map[string]int{},
+		release:  make(chan struct{}),
+	}
+	o.Server = httptest.NewServer(http.HandlerFunc(o.serve))
+	return o
+}
+
+// RandomData the same size gives the same data
+func RandomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// Add file at /name and return its url
+func (o *Origin) Add(name string, f File) string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.files[name] = &f
+	return o.URL + "/" + name
+}
+
+// Update change file while serving, requests already started are not affected
+func (o *Origin) Update(name string, update func(f *File)) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	f, exist := o.files[name]
+	if !exist {
+		return
+	}
+	copied := *f
+	update(&copied)
+	o.files[name] = &copied
+}
+
+func (o *Origin) Requests(name string) []Request {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]Request{}, o.requests[name]...)
+}
+
+// MaxActive most GET requests served at the same time
+func (o *Origin) MaxActive() int {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.maxActive
+}
+
+// Release stalled bodies continue, files do not stall any more
+func (o *Origin) Release() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.released {
+		o.released = true
+		close(o.release)
+	}
+}
+
+// Close release stalled bodies and close server
+func (o *Origin) Close() {
+	o.Release()
+	o.Server.Close()
+}
+
+func (o *Origin) serve(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	o.lock.Lock()
+	f, exist := o.files[name]
+	o.requests[name] = append(o.requests[name], Request{Method: r.Method, Range: r.Header.Get("Range")})
+	gets := 0
+	if r.Method == http.MethodGet {
+		o.gets[name]++
+		gets = o.gets[name]
+		o.active++
+		if o.active > o.maxActive {
+			o.maxActive = o.active
+		}
+		defer func() {
+			o.lock.Lock()
+			o.active--
+			o.lock.Unlock()
+		}()
+	}
+	release := o.release
+	o.lock.Unlock()
+	if !exist {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	failing := f.ErrorStatus != 0 && (f.ErrorTimes == 0 || gets <= f.ErrorTimes)
+	if failing && (r.Method == http.MethodGet || f.ErrorTimes == 0) {
+		w.WriteHeader(f.ErrorStatus)
+		return
+	}
+
+	size := int64(len(f.Data))
+	if f.ETag != "" {
+		w.Header().Set("ETag", f.ETag)
+	}
+	if !f.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", f.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if !f.NoRange {
+		w.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	start, end, partial := f.contentRange(r)
+	length := end - start + 1
+	if !partial && f.DeclaredSize > 0 {
+		length = f.DeclaredSize
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	body := f.Data[start : end+1]
+	if int64(len(body)) > length {
+		body = body[:length]
+	}
+	f.write(w, r, body, start, release)
+	//declared more than sent, client sees the connection closed
+	if int64(len(body)) < length {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// contentRange return the part to send, partial is false if whole file is sent with 200
+func (f *File) contentRange(r *http.Request) (int64, int64, bool) {
+	size := int64(len(f.Data))
+	rangeStr := r.Header.Get("Range")
+	if f.NoRange || !strings.HasPrefix(rangeStr, "bytes=") {
+		return 0, size - 1, false
+	}
+	//file changed
+	ifRange := r.Header.Get("If-Range")
+	if ifRange != "" && ifRange != f.ETag && (f.LastModified.IsZero() || ifRange != f.LastModified.UTC().Format(http.TimeFormat)) {
+		return 0, size - 1, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rangeStr, "bytes="), "-", 2)
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start >= size || len(parts) != 2 {
+		return 0, size - 1, false
+	}
+	end := size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, size - 1, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+func (f *File) write(w http.ResponseWriter, r *http.Request, body []byte, start int64, release chan struct{}) {
+	flusher, _ := w.(http.Flusher)
+	chunk := 4 * 1024
+	pos := start
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		//stop at StallAfter if this response crosses it
+		if f.StallAfter > 0 && pos < f.StallAfter && pos+int64(n) > f.StallAfter {
+			n = int(f.StallAfter - pos)
+		}
+		if n > 0 {
+			_, err := w.Write(body[:n])
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			body = body[n:]
+			pos += int64(n)
+		}
+		if f.StallAfter > 0 && pos == f.StallAfter && start < f.StallAfter {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.BytesPerSec > 0 && n > 0 {
+			select {
+			case <-time.After(time.Duration(n) * time.Second / time.Duration(f.BytesPerSec)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
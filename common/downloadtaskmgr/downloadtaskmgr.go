@@ -1,7 +1,8 @@
 package downloadtaskmgr
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"io"
 	"math"
 	"net"
@@ -9,8 +10,9 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/daqnext/meson-common/common/logger"
@@ -27,6 +29,16 @@ type DownloadInfo struct {
 	DownloadType string
 	OriginRegion string
 	TargetRegion string
+	//optional integrity check, empty means not check
+	ExpectedSize int64
+	ExpectedHash string
+	HashType     string       //md5 or sha256, default md5
+	HashBytes    int64        //only hash the first HashBytes of file like utils.HashLocalFile, 0 means whole file
+	MaxSpeedKBs  int64        //speed cap of this task, 0 means unlimited
+	Priority     TaskPriority //PriorityUrgent for live stream pre-cache
+	Sources      []string     //fallback urls like terminals which hold the file, tried in order after TargetUrl
+	NotBefore    int64        //unix time, task waits until then, 0 means at once
+	Deadline     int64        //unix time, task fails with FailReason_Expired if not finished by then, 0 means no deadline
 }
 
 type TaskStatus string
@@ -36,37 +48,48 @@ type TaskStatus string
 const Task_UnStart TaskStatus = "unstart"
 const Task_Break TaskStatus = "break"
 const Task_Downloading TaskStatus = "downloading"
+const Task_Paused TaskStatus = "paused"
+const Task_Cancelled TaskStatus = "cancelled"
+const Task_Expired TaskStatus = "expired"
 
+// DownloadTask fields changed while running are guarded by taskLock of manager,
+// use the copies passed to callbacks and events instead of reading a running task
 type DownloadTask struct {
 	DownloadInfo
-	Id              uint64
-	Status          TaskStatus
-	FileSize        int64
-	SpeedKBs        float64
-	DownloadedSize  int64
-	TryTimes        int
-	StartTime       int64
-	ZeroSpeedSec    int
-	DownloadChannel *DownloadChannel
+	Id                 uint64
+	Status             TaskStatus
+	FileSize           int64
+	SpeedKBs           float64
+	DownloadedSize     int64
+	TryTimes           int
+	StartTime          int64
+	ZeroSpeedSec       int
+	ETag               string
+	LastModified       string
+	Segments           []*DownloadSegment
+	FailReason         FailReason
+	FailStatusCode     int              //http status when FailReason is FailReason_HttpStatus
+	FailError          string           //error message of the last fail
+	SourceIndex        int              //index of the url in use, TargetUrl is 0 and Sources follow
+	SucceededSource    string           //url which the file is downloaded from
+	EvictTimes         int              //broken by LoopScanRunningTask to give place to waiting tasks
+	BreakReason        StopReason       //why the task was broken last time
+	PostProcessor      string           //name of the post processor running, empty when downloading
+	PostProcessPercent float64          //progress of PostProcessor
+	FileComplete       bool             //temp file is downloaded and verified, only post processors are left
+	DownloadChannel    *DownloadChannel `json:"-"`
+
+	runningChannel *DownloadChannel //nil means running as new task
+	limiter        *RateLimiter
 }
 
 type TaskList struct {
 	TaskInQueue []DownloadTask
 }
 
-var currentId uint64
-var idLock sync.Mutex
-
+// GlobalDownloadTaskChanSize max waiting new tasks
 const GlobalDownloadTaskChanSize = 1024 * 10
 
-var globalDownloadTaskChan = make(chan *DownloadTask, GlobalDownloadTaskChanSize)
-
-var onTaskSuccess func(task *DownloadTask)
-var onTaskFailed func(task *DownloadTask)
-var panicCatcher func()
-var onDownloadStart func(task *DownloadTask)
-var onDownloading func(task *DownloadTask, usedTimeSec int)
-
 type ExecResult string
 
 const Success ExecResult = "Success"
@@ -78,29 +101,20 @@ type DownloadChannel struct {
 	CountLimit              int
 	RunningCountControlChan chan bool
 	IdleChan                chan *DownloadTask
+	limiter                 *RateLimiter
+	manager                 *Manager
 }
 
-var DownloadingTaskMap sync.Map
-
 var ChannelRunningSize = []int{10, 6, 3, 3, 2}
-var channelArray = []*DownloadChannel{
-	{SpeedLimitKBs: 30, CountLimit: ChannelRunningSize[0], RunningCountControlChan: make(chan bool, ChannelRunningSize[0]), IdleChan: make(chan *DownloadTask, 1024*5)},   //30KB/s
-	{SpeedLimitKBs: 100, CountLimit: ChannelRunningSize[1], RunningCountControlChan: make(chan bool, ChannelRunningSize[1]), IdleChan: make(chan *DownloadTask, 1024*5)},  //100KB/s
-	{SpeedLimitKBs: 500, CountLimit: ChannelRunningSize[2], RunningCountControlChan: make(chan bool, ChannelRunningSize[2]), IdleChan: make(chan *DownloadTask, 1024*5)},  //500KB/s
-	{SpeedLimitKBs: 1500, CountLimit: ChannelRunningSize[3], RunningCountControlChan: make(chan bool, ChannelRunningSize[3]), IdleChan: make(chan *DownloadTask, 1024*3)}, //1500KB/s
-	{SpeedLimitKBs: 2500, CountLimit: ChannelRunningSize[4], RunningCountControlChan: make(chan bool, ChannelRunningSize[4]), IdleChan: make(chan *DownloadTask, 1024*3)}, //2500KB/s
-}
 
 const NewRunningTaskCount = 7
 
-var newRunningTaskControlChan = make(chan bool, NewRunningTaskCount)
-
-func AddTaskToDownloadingMap(task *DownloadTask) {
-	DownloadingTaskMap.Store(task.Id, task)
+func (m *Manager) AddTaskToDownloadingMap(task *DownloadTask) {
+	m.downloadingTaskMap.Store(task.Id, task)
 }
 
-func DeleteDownloadingTask(taskid uint64) {
-	DownloadingTaskMap.Delete(taskid)
+func (m *Manager) DeleteDownloadingTask(taskid uint64) {
+	m.downloadingTaskMap.Delete(taskid)
 }
 
 type BySpeed []*DownloadTask
@@ -108,155 +122,270 @@ type BySpeed []*DownloadTask
 func (t BySpeed) Len() int           { return len(t) }
 func (t BySpeed) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
 func (t BySpeed) Less(i, j int) bool { return t[i].SpeedKBs < t[j].SpeedKBs }
-func LoopScanRunningTask() {
-	newWaitingTaskCount := len(globalDownloadTaskChan)
+
+// LoopScanRunningTask break tasks picked by the eviction policy when tasks are waiting in global queue,
+// broken tasks continue in the channel which fits their speed
+func (m *Manager) LoopScanRunningTask() {
+	m.evictLock.Lock()
+	defer m.evictLock.Unlock()
+	now := m.clock.Now()
+	speeds := m.sampleSpeed(now)
+
+	newWaitingTaskCount := m.scheduler.len()
 	//logger.Debug("Download waiting len","len",newWaitingTaskCount)
 	if newWaitingTaskCount <= 0 {
 		//logger.Debug("have no new task waiting")
 		return
 	}
 
-	killCount := 3
-	if newWaitingTaskCount < killCount {
-		killCount = newWaitingTaskCount
+	candidates := m.evictionCandidates(now, speeds)
+	if len(candidates) == 0 {
+		return
 	}
-
-	nowTime := time.Now().Unix()
-	taskReadyToKill := []*DownloadTask{}
-	DownloadingTaskMap.Range(func(key, value interface{}) bool {
-		task, ok := value.(*DownloadTask)
-		if ok {
-			//loop find task to kill
-			if nowTime-task.StartTime < 5 {
-				return true
-			}
-
-			for _, v := range channelArray {
-				if task.SpeedKBs < float64(v.SpeedLimitKBs) {
-					//if task.FileSize>0  {
-					//	finishPercent:=task.DownloadedSize*100/task.FileSize
-					//	if finishPercent>70 {
-					//		break
-					//	}
-					//}
-					task.DownloadChannel = v
-					taskReadyToKill = append(taskReadyToKill, task)
-					break
-				}
-			}
+	for _, v := range m.evictionPolicy.SelectEvictions(candidates, newWaitingTaskCount) {
+		task := m.loadTask(v.TaskId)
+		if task == nil || v.Channel < 0 || v.Channel >= len(m.channelArray) {
+			continue
+		}
+		m.taskLock.Lock()
+		evicted := m.breakRunningTaskLocked(task, StopReason_Evicted)
+		if evicted {
+			//TaskBreak saves them
+			task.DownloadChannel = m.channelArray[v.Channel]
+			task.EvictTimes++
 		}
-		return true
-	})
+		m.taskLock.Unlock()
+		if evicted {
+			logger.Debug("Break Task", "id", v.TaskId, "recentSpeed", v.RecentSpeedKBs, "percent", v.Percent, "evictTimes", v.EvictTimes+1)
+		}
+	}
+}
 
-	if len(taskReadyToKill) == 0 {
-		return
+func (m *Manager) Init(rootPath string) error {
+	err := m.SetTransportConfig(m.config.Transport)
+	if err != nil {
+		logger.Error("download transport config error", "err", err)
+		return err
 	}
 
-	sort.Sort(BySpeed(taskReadyToKill))
-	count := 0
-	for _, v := range taskReadyToKill {
-		v.Status = Task_Break
-		//logger.Debug("Break Task","id",v.Id)
-		count++
-		if count >= killCount {
-			return
+	if m.store == nil {
+		store, err := openTaskStore(m.config.DBPath)
+		if err != nil {
+			logger.Error("open task leveldb error", "err", err, "path", m.config.DBPath)
+			return err
 		}
+		m.store = store
 	}
-}
 
-func InitTaskMgr(rootPath string) {
-	LevelDBInit()
+	//read unfinished task and restart
+	unFinishedTask, err := m.LoopTasksInLDB()
+	if err != nil {
+		return err
+	}
+
+	//restore tasks with their own ids, records are updated in place so no orphan is left
+	restoreTasks := []*DownloadTask{}
+	keepTasks := []*DownloadTask{}
+	for _, v := range unFinishedTask {
+		m.idLock.Lock()
+		if v.Id > m.currentId {
+			m.currentId = v.Id
+		}
+		m.idLock.Unlock()
+
+		switch v.Status {
+		case Task_Cancelled:
+			//stopped before the record was deleted
+			m.taskLock.Lock()
+			m.cleanCancelledTaskLocked(v)
+			m.taskLock.Unlock()
+			continue
+		case Task_Paused:
+			//paused task keep its record and wait for ResumeTask
+			m.taskMap.Store(v.Id, v)
+			keepTasks = append(keepTasks, v)
+			continue
+		}
 
-	for _, v := range channelArray {
-		for i := 0; i < v.CountLimit; i++ {
-			v.RunningCountControlChan <- true
+		//runtime state of last run
+		v.Status = Task_UnStart
+		v.SpeedKBs = 0
+		v.ZeroSpeedSec = 0
+		v.StartTime = 0
+		restoreTasks = append(restoreTasks, v)
+		keepTasks = append(keepTasks, v)
+	}
+	//older versions could save the same file twice, both would write to one temp file, so the later ones are dropped
+	sort.Slice(keepTasks, func(i, j int) bool { return keepTasks[i].Id < keepTasks[j].Id })
+	dropped := map[uint64]bool{}
+	for _, v := range keepTasks {
+		if m.indexTasks([]*DownloadTask{v}, nil) != nil {
+			logger.Error("drop duplicated task in leveldb", "id", v.Id, "savePath", v.SavePath)
+			dropped[v.Id] = true
+			m.taskMap.Delete(v.Id)
+			m.DelTaskFromLDB(v.Id)
 		}
 	}
+	if len(dropped) > 0 {
+		keepTasks = withoutTasks(keepTasks, dropped)
+		restoreTasks = withoutTasks(restoreTasks, dropped)
+	}
+	//left by crash or tasks removed while stopped
+	if m.config.CleanTempFiles {
+		cleanTempFiles(rootPath, keepTasks)
+	}
 
-	for i := 0; i < NewRunningTaskCount; i++ {
-		newRunningTaskControlChan <- true
+	if len(restoreTasks) == 0 {
+		return nil
 	}
 
-	//read unfinished task and restart
-	unFinishedTask := LoopTasksInLDB()
-	if unFinishedTask == nil {
-		return
+	err = m.SetTasksToLDB(restoreTasks)
+	if err != nil {
+		return err
 	}
+	for _, v := range restoreTasks {
+		logger.Debug("restore task", "id", v.Id, "tryTimes", v.TryTimes, "downloaded", v.DownloadedSize)
+		m.taskMap.Store(v.Id, v)
+		//restored tasks are not limited by queue size
+		m.queueTask(v, nil)
+	}
+	return nil
+}
 
-	for _, v := range unFinishedTask {
-		info := &DownloadInfo{}
-		info.TargetUrl = v.TargetUrl
-		info.BindName = v.BindName
-		info.FileName = v.FileName
-		info.Continent = v.Continent
-		info.Country = v.Country
-		info.Area = v.Area
-		info.SavePath = v.SavePath
-
-		err := AddGlobalDownloadTask(info)
-		if err != nil {
-			logger.Error("Add AddGlobalDownloadTask error")
+func withoutTasks(tasks []*DownloadTask, ids map[uint64]bool) []*DownloadTask {
+	result := []*DownloadTask{}
+	for _, v := range tasks {
+		if !ids[v.Id] {
+			result = append(result, v)
 		}
 	}
+	return result
 }
 
-func AddGlobalDownloadTask(info *DownloadInfo) error {
+func (m *Manager) AddGlobalDownloadTask(info *DownloadInfo) error {
+	return m.AddGlobalDownloadTasks([]*DownloadInfo{info})
+}
 
-	idLock.Lock()
-	if currentId >= math.MaxUint64 {
-		currentId = 0
+// AddTask same as AddGlobalDownloadTask and return the id of new task
+func (m *Manager) AddTask(info *DownloadInfo) (uint64, error) {
+	ids, err := m.addTasks([]*DownloadInfo{info}, nil)
+	if err != nil {
+		return 0, err
 	}
-	currentId++
-	idLock.Unlock()
+	return ids[0], nil
+}
 
-	newTask := &DownloadTask{}
-	newTask.Id = currentId
-	newTask.TargetUrl = info.TargetUrl
-	newTask.BindName = info.BindName
-	newTask.FileName = info.FileName
-	newTask.Continent = info.Continent
-	newTask.Country = info.Country
-	newTask.Area = info.Area
-	newTask.DownloadType = info.DownloadType
-	newTask.OriginRegion = info.OriginRegion
-	newTask.TargetRegion = info.TargetRegion
-	newTask.SavePath = info.SavePath
-	newTask.Status = Task_UnStart
-	newTask.TryTimes = 0
+// AddGlobalDownloadTasks save all tasks in one leveldb write, no task is added if error.
+// TaskExistError is returned if the same file is already queued or running.
+func (m *Manager) AddGlobalDownloadTasks(infos []*DownloadInfo) error {
+	_, err := m.addTasks(infos, nil)
+	return err
+}
 
-	go func() {
-		//save to LevelDB
-		SetTaskToLDB(newTask)
-		//to task channel
-		globalDownloadTaskChan <- newTask
-	}()
+func (m *Manager) addTasks(infos []*DownloadInfo, onDone TaskDoneCallback) ([]uint64, error) {
+	err := m.checkNewTasks(infos)
+	if err != nil {
+		return nil, err
+	}
+
+	newTasks := []*DownloadTask{}
+	ids := []uint64{}
+	for _, v := range infos {
+		newTask := &DownloadTask{}
+		newTask.Id = m.nextId()
+		newTask.DownloadInfo = *v
+		newTask.Status = Task_UnStart
+		newTask.TryTimes = 0
+		newTasks = append(newTasks, newTask)
+		ids = append(ids, newTask.Id)
+	}
+	err = m.saveNewTasks(newTasks, onDone)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
 
+// checkNewTasks return error if any of the tasks can not be added
+func (m *Manager) checkNewTasks(infos []*DownloadInfo) error {
+	for _, v := range infos {
+		err := checkHashType(v.HashType)
+		if err != nil {
+			return err
+		}
+		err = m.checkSpace(v)
+		if err != nil {
+			return err
+		}
+		if v.Deadline > 0 && m.clock.Now().Unix() >= v.Deadline {
+			return ErrTaskExpired
+		}
+	}
+	if m.isClosing() {
+		return ErrManagerClosed
+	}
+	if m.config.GlobalQueueSize > 0 && m.scheduler.len()+len(infos) > m.config.GlobalQueueSize {
+		return ErrQueueFull
+	}
 	return nil
 }
 
-func SetPanicCatcher(function func()) {
-	panicCatcher = function
+// saveNewTasks save tasks to leveldb and queue them, nothing is saved if any of them is duplicated
+func (m *Manager) saveNewTasks(newTasks []*DownloadTask, onDone TaskDoneCallback) error {
+	err := m.indexTasks(newTasks, onDone)
+	if err != nil {
+		return err
+	}
+
+	//save to LevelDB
+	err = m.SetTasksToLDB(newTasks)
+	if err != nil {
+		for _, v := range newTasks {
+			m.unindexTask(v)
+		}
+		return err
+	}
+	for _, v := range newTasks {
+		m.taskMap.Store(v.Id, v)
+		//to task queue
+		m.queueTask(v, nil)
+	}
+	return nil
 }
 
-func SetOnTaskSuccess(function func(task *DownloadTask)) {
-	onTaskSuccess = function
+func (m *Manager) nextId() uint64 {
+	m.idLock.Lock()
+	defer m.idLock.Unlock()
+	if m.currentId >= math.MaxUint64 {
+		m.currentId = 0
+	}
+	m.currentId++
+	return m.currentId
 }
 
-func SetOnTaskFailed(function func(task *DownloadTask)) {
-	onTaskFailed = function
+func (m *Manager) SetPanicCatcher(function func()) {
+	m.panicCatcher = function
 }
 
-func SetOnDownloading(function func(task *DownloadTask, usedTimeSec int)) {
-	onDownloading = function
+func (m *Manager) SetOnTaskSuccess(function func(task *DownloadTask)) {
+	m.onTaskSuccess = function
 }
 
-func SetOnDownloadStart(function func(task *DownloadTask)) {
-	onDownloadStart = function
+func (m *Manager) SetOnTaskFailed(function func(task *DownloadTask)) {
+	m.onTaskFailed = function
 }
 
-func GetDownloadTaskList() []*DownloadTask {
-	taskInLDB := LoopTasksInLDB()
-	if taskInLDB == nil {
+func (m *Manager) SetOnDownloading(function func(task *DownloadTask, usedTimeSec int)) {
+	m.onDownloading = function
+}
+
+func (m *Manager) SetOnDownloadStart(function func(task *DownloadTask)) {
+	m.onDownloadStart = function
+}
+
+func (m *Manager) GetDownloadTaskList() []*DownloadTask {
+	taskInLDB, err := m.LoopTasksInLDB()
+	if err != nil {
 		return nil
 	}
 
@@ -267,137 +396,275 @@ func GetDownloadTaskList() []*DownloadTask {
 	return list
 }
 
-func TaskSuccess(task *DownloadTask) {
+func (m *Manager) TaskSuccess(task *DownloadTask) {
 	logger.Debug("Task Success", "id", task.Id)
 	//从map中删除任务
-	DelTaskFromLDB(task.Id)
-	DeleteDownloadingTask(task.Id)
-	if onTaskSuccess == nil {
+	m.DelTaskFromLDB(task.Id)
+	m.DeleteDownloadingTask(task.Id)
+	m.taskMap.Delete(task.Id)
+	m.publish(Event_Succeeded, task, 0)
+	m.finishTask(task, true)
+	if m.onTaskSuccess == nil {
 		logger.Error("not define onTaskSuccess")
 		return
 	}
-	onTaskSuccess(task)
+	m.onTaskSuccess(m.snapshotTask(task))
 }
 
-func TaskFail(task *DownloadTask) {
+func (m *Manager) TaskFail(task *DownloadTask) {
 	logger.Debug("Task Fail", "id", task.Id)
 	//从map中删除任务
-	DelTaskFromLDB(task.Id)
-	DeleteDownloadingTask(task.Id)
-	if onTaskFailed == nil {
+	m.DelTaskFromLDB(task.Id)
+	m.DeleteDownloadingTask(task.Id)
+	m.taskMap.Delete(task.Id)
+	//no more retry, partial file is useless
+	os.Remove(tempFilePath(task.SavePath))
+	m.keepFailedTask(task)
+	m.publish(Event_Failed, task, 0)
+	m.finishTask(task, false)
+	if m.onTaskFailed == nil {
 		logger.Error("not define onTaskFailed")
 		return
 	}
-	onTaskFailed(task)
+	m.onTaskFailed(m.snapshotTask(task))
 }
 
-func TaskBreak(task *DownloadTask) {
+func (m *Manager) TaskBreak(task *DownloadTask) {
 	logger.Debug("Task Break", "id", task.Id)
 	//delete from runningMap
-	DeleteDownloadingTask(task.Id)
-	task.Status = Task_UnStart
+	m.DeleteDownloadingTask(task.Id)
+	//keep downloaded size for resume
+	m.SetTaskToLDB(task)
+	m.publish(Event_Broken, task, 0)
 	//add to queue
+	m.taskLock.Lock()
 	channel := task.DownloadChannel
+	m.taskLock.Unlock()
 	if channel == nil {
 		logger.Error("Break Task not set channel,back to global list", "taskid", task.Id)
-		globalDownloadTaskChan <- task
+		m.queueTask(task, nil)
 		return
 	}
-	channel.IdleChan <- task
+	m.queueTask(task, channel)
 	logger.Debug("add break task to idleChan", "speedLimit", channel.SpeedLimitKBs, "chanLen", len(channel.IdleChan), "taskid", task.Id)
 }
 
-func TaskRetry(task *DownloadTask) {
-	logger.Debug("Task Retry", "id", task.Id)
-	DeleteDownloadingTask(task.Id)
+func (m *Manager) TaskRetry(task *DownloadTask) {
+	m.DeleteDownloadingTask(task.Id)
+	m.taskLock.Lock()
 	task.TryTimes++
-	task.Status = Task_UnStart
-	globalDownloadTaskChan <- task
+	//all sources failed, try from the first one again
+	if task.SourceIndex > 0 {
+		task.SourceIndex = 0
+		task.DownloadedSize = 0
+		task.Segments = nil
+	}
+	m.taskLock.Unlock()
+	m.SetTaskToLDB(task)
+	delay := m.config.RetryPolicy.backoff(task.TryTimes)
+	logger.Debug("Task Retry", "id", task.Id, "tryTimes", task.TryTimes, "reason", task.FailReason, "delay", delay)
+	m.publish(Event_Retried, task, 0)
+	m.queueTaskAfter(task, delay)
+}
+
+// TaskDefer wait for disk space, it is not counted as a retry
+func (m *Manager) TaskDefer(task *DownloadTask) {
+	logger.Debug("Task Defer", "id", task.Id, "reason", task.FailReason)
+	m.DeleteDownloadingTask(task.Id)
+	m.SetTaskToLDB(task)
+	m.publish(Event_Deferred, task, 0)
+	m.queueTaskAfter(task, m.config.NoSpaceRetryInterval)
 }
 
-func StartTask(task *DownloadTask) {
-	if panicCatcher != nil {
-		defer panicCatcher()
+func (m *Manager) StartTask(task *DownloadTask) {
+	if m.panicCatcher != nil {
+		defer m.panicCatcher()
+	}
+
+	//the host connection is given back before the task is queued again, so the next run takes its own
+	hostReleased := false
+	defer func() {
+		if !hostReleased {
+			m.releaseHost(task)
+		}
+	}()
+
+	ctx := m.startRun(task)
+	result := m.ExecDownloadTask(ctx, task)
+	reason := m.endRun(task)
+	m.releaseHost(task)
+	hostReleased = true
+	//stopped while failing, the error is caused by cancel
+	if result == Fail && reason != "" {
+		m.setFail(task, "", 0, nil)
+		result = Break
+	}
+
+	m.taskLock.Lock()
+	delete(m.runs, task.Id)
+	//paused or cancelled by user
+	stopped := (result != Success || task.Status == Task_Cancelled) && m.handleStoppedTaskLocked(task)
+	if !stopped {
+		switch result {
+		case Success:
+			task.SucceededSource = task.source()
+		case Break:
+			task.BreakReason = reason
+		}
+	}
+	m.taskLock.Unlock()
+	if stopped {
+		return
 	}
 
-	result := ExecDownloadTask(task)
 	switch result {
 	case Success:
 		//logger.Debug("download task success", "id", task.Id)
-		TaskSuccess(task)
+		m.TaskSuccess(task)
 	case Fail:
 		//logger.Debug("download task fail", "id", task.Id)
-		if task.TryTimes >= 2 {
-			TaskFail(task)
+		if task.FailReason == FailReason_NoSpace {
+			m.TaskDefer(task)
+			return
+		}
+		if sourceFailed(task.FailReason) && task.hasNextSource() {
+			m.TaskSwitchSource(task)
+			return
+		}
+		//permanent fail like 404 or wrong file content, retry is useless
+		if !m.config.RetryPolicy.shouldRetry(task) {
+			m.TaskFail(task)
 		} else {
 			//继续放入任务队列
-			TaskRetry(task)
+			m.TaskRetry(task)
 		}
 	case Break:
 		//logger.Debug("download task idle", "id", task.Id)
-		TaskBreak(task)
+		switch reason {
+		case StopReason_SlowSource:
+			m.TaskSwitchSource(task)
+			return
+		case StopReason_Expired:
+			m.setFail(task, FailReason_Expired, 0, ErrTaskExpired)
+			m.TaskFail(task)
+			return
+		}
+		m.TaskBreak(task)
 	}
 }
 
 func (dc *DownloadChannel) ChannelDownload() {
+	m := dc.manager
+	m.loopWg.Add(1)
 	go func() {
+		defer m.loopWg.Done()
 		for true {
 			//拿到自己队列的token
-			<-dc.RunningCountControlChan
 			select {
+			case <-dc.RunningCountControlChan:
+			case <-m.stopChan:
+				return
+			}
+			select {
+			case <-m.stopChan:
+				dc.RunningCountControlChan <- true
+				return
 			case task := <-dc.IdleChan:
+				//host is full, task will be queued again
+				if !m.acquireHost(task, dc) {
+					dc.RunningCountControlChan <- true
+					continue
+				}
+				if !m.dequeueTask(task, dc) {
+					m.releaseHost(task)
+					dc.RunningCountControlChan <- true
+					continue
+				}
+				m.taskWg.Add(1)
 				go func() {
 					defer func() {
 						dc.RunningCountControlChan <- true
+						m.taskWg.Done()
 					}()
 					logger.Debug("get a task from idle list", "channel speed", dc.SpeedLimitKBs, "id", task.Id, "chanlen", len(dc.IdleChan))
 					//执行任务
-					StartTask(task)
+					dc.manager.StartTask(task)
 				}()
 			}
 		}
 	}()
 }
 
-func Run() {
-	RunNewTask()
-	RunChannelDownload()
+func (m *Manager) Run() {
+	m.RunNewTask()
+	m.RunChannelDownload()
 
+	m.applyBandwidthSchedule()
 	//scanloop
+	m.loopWg.Add(1)
 	go func() {
-		if panicCatcher != nil {
-			defer panicCatcher()
+		defer m.loopWg.Done()
+		if m.panicCatcher != nil {
+			defer m.panicCatcher()
 		}
+		ticker := m.clock.NewTicker(ScanInterval)
+		defer ticker.Stop()
 		for true {
-			time.Sleep(5 * time.Second)
-			LoopScanRunningTask()
+			select {
+			case <-ticker.C():
+			case <-m.stopChan:
+				return
+			}
+			m.LoopScanRunningTask()
+			m.breakSlowSources()
+			m.expireTasks()
+			m.applyBandwidthSchedule()
 		}
 	}()
 }
-func RunChannelDownload() {
-	for _, v := range channelArray {
+func (m *Manager) RunChannelDownload() {
+	for _, v := range m.channelArray {
 		v.ChannelDownload()
 	}
 }
-func RunNewTask() {
+func (m *Manager) RunNewTask() {
+	m.loopWg.Add(1)
 	go func() {
+		defer m.loopWg.Done()
 		for true {
-			<-newRunningTaskControlChan
 			select {
-			case task := <-globalDownloadTaskChan:
-				//开始一个新下载任务
-				go func() {
-					//任务结束,放回token
-					defer func() {
-						newRunningTaskControlChan <- true
-					}()
-					//执行任务
-					//logger.Debug("start a new task", "id", task.Id)
-					task.Status = Task_Downloading
-					AddTaskToDownloadingMap(task)
-					StartTask(task)
-				}()
+			case <-m.newRunningTaskControlChan:
+			case <-m.stopChan:
+				return
+			}
+			//by priority and BindName
+			task := m.scheduler.pop(m.stopChan)
+			if task == nil {
+				m.newRunningTaskControlChan <- true
+				return
+			}
+			if !m.acquireHost(task, nil) {
+				m.newRunningTaskControlChan <- true
+				continue
 			}
+			if !m.dequeueTask(task, nil) {
+				m.releaseHost(task)
+				m.newRunningTaskControlChan <- true
+				continue
+			}
+			//开始一个新下载任务
+			m.taskWg.Add(1)
+			go func() {
+				//任务结束,放回token
+				defer func() {
+					m.newRunningTaskControlChan <- true
+					m.taskWg.Done()
+				}()
+				//执行任务
+				//logger.Debug("start a new task", "id", task.Id)
+				m.AddTaskToDownloadingMap(task)
+				m.StartTask(task)
+			}()
 		}
 	}()
 }
@@ -419,89 +686,166 @@ func TimeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, ad
 	}
 }
 
-func ExecDownloadTask(task *DownloadTask) ExecResult {
-	connectTimeout := 10 * time.Second
-	readWriteTimeout := 3600 * 12 * time.Second
-	//readWriteTimeout := time.Duration(0)
-
-	url := task.TargetUrl
-	distFilePath := task.SavePath
-
-	cHead := http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(connectTimeout, readWriteTimeout),
-		},
+// ExecDownloadTask download the file once, Break is returned when ctx is cancelled
+func (m *Manager) ExecDownloadTask(ctx context.Context, task *DownloadTask) ExecResult {
+	url := task.source()
+	//written to temp file, SavePath only appears when download is finished
+	distFilePath := tempFilePath(task.SavePath)
+	m.setFail(task, "", 0, nil)
+	//stopped while post processing last time, the file is not downloaded again
+	if m.fileCompleteLeft(task) {
+		return m.completeDownload(ctx, task)
+	}
+	err := checkTargetUrl(url)
+	if err != nil {
+		logger.Error("download url error", "err", err, "id", task.Id)
+		return m.failTask(task, FailReason_BadUrl, err)
 	}
+
+	c := m.httpClient()
 	//get
-	reqHead, err := http.NewRequest(http.MethodHead, url, nil)
+	acceptRanges := false
+	etag := ""
+	lastModified := ""
+	reqHead, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
 	if err == nil {
-		responseHead, err := cHead.Do(reqHead)
+		responseHead, err := c.Do(reqHead)
 		if err == nil {
-			if responseHead.StatusCode == 200 && responseHead.ContentLength > 0 {
-				task.FileSize = responseHead.ContentLength
+			if responseHead.StatusCode == 200 {
+				if responseHead.ContentLength > 0 {
+					m.taskLock.Lock()
+					task.FileSize = responseHead.ContentLength
+					m.taskLock.Unlock()
+				}
+				acceptRanges = strings.EqualFold(responseHead.Header.Get("Accept-Ranges"), "bytes")
+				etag = responseHead.Header.Get("ETag")
+				lastModified = responseHead.Header.Get("Last-Modified")
 			}
+			responseHead.Body.Close()
 		}
 	}
 
-	//http client
-	c := http.Client{
-		Transport: &http.Transport{
-			Dial: TimeoutDialer(connectTimeout, readWriteTimeout),
-		},
+	if task.ExpectedSize > 0 && task.FileSize > 0 && task.FileSize != task.ExpectedSize {
+		logger.Error("origin file size not expected", "id", task.Id, "fileSize", task.FileSize, "expectedSize", task.ExpectedSize)
+		return m.failTask(task, FailReason_SizeMismatch, nil)
+	}
+
+	//reserve space for the rest of file
+	err = m.reserveSpace(task)
+	if err != nil {
+		logger.Error("not enough disk space", "id", task.Id, "fileSize", task.FileSize, "path", task.SavePath)
+		return m.failTask(task, FailReason_NoSpace, err)
+	}
+	defer m.releaseSpace(task.Id)
+
+	if m.useSegmentDownload(task, acceptRanges, etag, lastModified) {
+		return m.execSegmentDownload(ctx, task, c, etag, lastModified)
 	}
+
+	//continue from the partial file if origin file not changed
+	offset := resumeOffset(task, acceptRanges, etag, lastModified)
+	m.taskLock.Lock()
+	task.ETag = etag
+	task.LastModified = lastModified
+	task.Segments = nil
+	m.taskLock.Unlock()
 	//get
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		logger.Error("create request error", "err", err)
-		return Fail
+		return m.failTask(task, FailReason_BadUrl, err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", ifRangeValidator(etag, lastModified))
 	}
 	//download
 	response, err := c.Do(req)
 	if err != nil {
+		if ctx.Err() != nil {
+			return Break
+		}
 		logger.Error("get file url "+url+" error", "err", err)
-		return Fail
+		return m.failTaskByError(task, err)
+	}
+	if response.Body == nil {
+		logger.Error("Download responseBody is null")
+		return m.failTask(task, FailReason_Network, nil)
 	}
-	if response.StatusCode != 200 {
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case 200:
+		//origin ignored range or file changed, download whole file
+		offset = 0
+	case 206:
+		if offset == 0 || contentRangeStart(response.Header.Get("Content-Range")) != offset {
+			logger.Error("get file url "+url+" content range error", "offset", offset, "contentRange", response.Header.Get("Content-Range"))
+			//do not trust validators next time
+			m.taskLock.Lock()
+			task.ETag = ""
+			task.LastModified = ""
+			m.taskLock.Unlock()
+			return m.failTask(task, FailReason_ContentRange, nil)
+		}
+		logger.Debug("resume download task", "id", task.Id, "offset", offset)
+	default:
 		logger.Error("get file url "+url+" error", "err", err, "statusCode", response.StatusCode)
-		return Fail
+		return m.failTaskByError(task, &statusError{code: response.StatusCode})
+	}
+	verifier := newIntegrityVerifier(task)
+	err = verifier.prime(distFilePath, offset)
+	if err != nil {
+		logger.Error("hash downloaded part error", "err", err, "id", task.Id)
+		//next try download from beginning
+		m.taskLock.Lock()
+		task.DownloadedSize = 0
+		m.taskLock.Unlock()
+		return m.failTask(task, FailReason_FileError, err)
 	}
 	//creat folder and file
 	distDir := path.Dir(distFilePath)
 	err = os.MkdirAll(distDir, os.ModePerm)
 	if err != nil {
-		return Fail
+		return m.failTaskByError(task, err)
 	}
-	file, err := os.Create(distFilePath)
+	file, err := openDownloadFile(distFilePath, offset)
 	if err != nil {
-		return Fail
+		logger.Error("open download file error", "err", err, "path", distFilePath)
+		return m.failTaskByError(task, err)
 	}
 	defer file.Close()
-	if response.Body == nil {
-		logger.Error("Download responseBody is null")
-		return Fail
-	}
-	defer response.Body.Close()
 
-	task.StartTime = time.Now().Unix()
-	if onDownloadStart != nil {
-		go onDownloadStart(task)
-	}
+	m.setStarted(task)
 
-	_, err = copyBuffer(file, response.Body, nil, task)
+	written, err := m.copyBuffer(ctx, file, &verifyingReadCloser{ReadCloser: response.Body, verifier: verifier}, nil, task, offset, m.taskLimiters(task))
+	m.taskLock.Lock()
+	task.DownloadedSize = offset + written
+	m.taskLock.Unlock()
 
 	if err != nil {
-		os.Remove(distFilePath)
-		if err.Error() == string(Break) {
-			//logger.Debug("task break","id",task.Id)
+		//cancelled by LoopScanRunningTask, PauseTask or CancelTask, keep the partial file to resume
+		if ctx.Err() != nil {
 			return Break
 		}
-		return Fail
+		if err == errSizeMismatch {
+			logger.Error("download file exceed expected size", "id", task.Id, "expectedSize", task.ExpectedSize)
+			os.Remove(distFilePath)
+			return m.failTask(task, FailReason_SizeMismatch, err)
+		}
+		logger.Error("download file error", "err", err, "id", task.Id)
+		return m.failTaskByError(task, err)
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		logger.Error("sync download file error", "err", err, "path", distFilePath)
+		return m.failTaskByError(task, err)
 	}
 	fileInfo, err := os.Stat(distFilePath)
 	if err != nil {
 		logger.Error("Get file Stat error", "err", err)
 		os.Remove(distFilePath)
-		return Fail
+		return m.failTask(task, FailReason_FileError, err)
 	}
 	size := fileInfo.Size()
 	logger.Debug("donwload file,fileInfo", "size", size)
@@ -509,22 +853,87 @@ func ExecDownloadTask(task *DownloadTask) ExecResult {
 	if size == 0 {
 		os.Remove(distFilePath)
 		logger.Error("download file size error")
-		return Fail
+		return m.failTask(task, FailReason_Incomplete, nil)
 	}
 
-	return Success
+	reason := verifier.check(size)
+	if reason != "" {
+		logger.Error("download file integrity check fail", "id", task.Id, "reason", reason)
+		os.Remove(distFilePath)
+		return m.failTask(task, reason, nil)
+	}
+	return m.completeDownload(ctx, task)
 }
 
-func copyBuffer(dst io.Writer, src io.Reader, buf []byte, task *DownloadTask) (written int64, err error) {
-	// If the reader has a WriteTo method, use it to do the copy.
-	// Avoids an allocation and a copy.
-	if wt, ok := src.(io.WriterTo); ok {
-		return wt.WriteTo(dst)
+// resumeOffset return the size of partial file which can be continued, 0 means download from beginning.
+// Size is taken from the file, DownloadedSize is not saved after a crash but validators are saved when body starts.
+func resumeOffset(task *DownloadTask, acceptRanges bool, etag string, lastModified string) int64 {
+	//file of segmented download is allocated to full size, can not tell the continuous part
+	if !acceptRanges || len(task.Segments) > 0 {
+		return 0
+	}
+	if ifRangeValidator(etag, lastModified) == "" {
+		return 0
 	}
-	// Similarly, if the writer has a ReadFrom method, use it to do the copy.
-	if rt, ok := dst.(io.ReaderFrom); ok {
-		return rt.ReadFrom(src)
+	if task.ETag != etag || task.LastModified != lastModified {
+		logger.Debug("origin file changed, download from beginning", "id", task.Id)
+		return 0
 	}
+	fileInfo, err := os.Stat(tempFilePath(task.SavePath))
+	if err != nil {
+		return 0
+	}
+	offset := fileInfo.Size()
+	if task.FileSize > 0 && offset >= task.FileSize {
+		return 0
+	}
+	return offset
+}
+
+// ifRangeValidator weak etag can not be used in If-Range
+func ifRangeValidator(etag string, lastModified string) string {
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return lastModified
+}
+
+// contentRangeStart parse start position from "bytes 100-999/1000", return -1 when invalid
+func contentRangeStart(contentRange string) int64 {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return -1
+	}
+	rangeStr := strings.TrimPrefix(contentRange, "bytes ")
+	index := strings.Index(rangeStr, "-")
+	if index <= 0 {
+		return -1
+	}
+	start, err := strconv.ParseInt(rangeStr[:index], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+func openDownloadFile(distFilePath string, offset int64) (*os.File, error) {
+	file, err := os.OpenFile(distFilePath, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Truncate(offset)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// copyBuffer do not use WriterTo or ReaderFrom, every read must pass the speed monitor and limiters.
+// The error is ctx.Err() if download is cancelled.
+func (m *Manager) copyBuffer(ctx context.Context, dst io.Writer, src io.Reader, buf []byte, task *DownloadTask, offset int64, limiters []*RateLimiter) (written int64, err error) {
 	if buf == nil {
 		size := 32 * 1024
 		if l, ok := src.(*io.LimitedReader); ok && int64(size) > l.N {
@@ -536,81 +945,69 @@ func copyBuffer(dst io.Writer, src io.Reader, buf []byte, task *DownloadTask) (w
 		}
 		buf = make([]byte, size)
 	}
-	stop := false
 
-	srcWithCloser, ok := src.(io.ReadCloser)
-	if ok == false {
-		err = errors.New("to io.ReadCloser error")
-		return written, err
-	}
+	//monitor download speed
+	monitored := int64(0) //written, read by monitor
+	done := make(chan struct{})
+	monitorDone := make(chan struct{})
 	go func() {
+		defer close(monitorDone)
+		ticker := m.clock.NewTicker(SpeedInterval)
+		defer ticker.Stop()
+		startTime := m.clock.Now()
 		for {
-			time.Sleep(500 * time.Millisecond) //for test
-			nr, er := srcWithCloser.Read(buf)
-			if nr > 0 {
-				nw, ew := dst.Write(buf[0:nr])
-				if nw > 0 {
-					written += int64(nw)
-				}
-
-				if ew != nil {
-					err = ew
-					//fmt.Println(ew.Error())
-					if task.Status == Task_Break &&
-						(strings.Contains(err.Error(), "http: read on closed response body") ||
-							strings.Contains(err.Error(), "use of closed network connection")) {
-						err = errors.New(string(Break))
-					}
-					break
-				}
-				if nr != nw {
-					err = io.ErrShortWrite
-					break
-				}
-			}
-			if er != nil {
-				if er != io.EOF {
-					err = er
-					//errStr:=err.Error()
-					//fmt.Println(errStr)
-					if task.Status == Task_Break &&
-						(strings.Contains(err.Error(), "http: read on closed response body") ||
-							strings.Contains(err.Error(), "use of closed network connection")) {
-						err = errors.New(string(Break))
-					}
+			select {
+			case <-done:
+				return
+			case <-ticker.C():
+				wtn := atomic.LoadInt64(&monitored)
+				//real used time, read may be delayed by limiters
+				useTime := int(m.clock.Now().Sub(startTime) / time.Millisecond)
+				if useTime <= 0 {
+					continue
 				}
-				break
+				//reportDownloadState
+				m.setProgress(task, offset+wtn, float64(wtn)/float64(useTime), nil, useTime)
 			}
 		}
-		stop = true
 	}()
 
-	//monitor download speed
-	spaceTime := time.Millisecond * 1000
-	ticker := time.NewTicker(spaceTime)
-	//lastWtn := int64(0)
-	count := 0
 	for {
-		count++
-		if stop {
-			break
-		}
-		select {
-		case <-ticker.C:
-			if task.Status == Task_Break {
-				srcWithCloser.Close()
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			//data already read is written even if cancelled while waiting
+			el := waitLimiters(ctx, nr, limiters...)
+			nw, ew := dst.Write(buf[0:nr])
+			if nw > 0 {
+				written += int64(nw)
+				atomic.StoreInt64(&monitored, written)
 			}
-
-			task.DownloadedSize = written
-			useTime := count * 1000
-			speed := float64(written) / float64(useTime)
-			task.SpeedKBs = speed
-			//reportDownloadState
-			if onDownloading != nil {
-				go onDownloading(task, useTime)
+			if ew != nil {
+				err = ew
+				break
+			}
+			if nr != nw {
+				err = io.ErrShortWrite
+				break
+			}
+			if el != nil {
+				err = el
+				break
 			}
-
 		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			break
+		}
+	}
+	close(done)
+	<-monitorDone
+
+	//read error caused by cancel
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
 	}
 	return written, err
 }
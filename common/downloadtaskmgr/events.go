@@ -0,0 +1,120 @@
+package downloadtaskmgr
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type EventType string
+
+const (
+	Event_Queued     EventType = "queued"
+	Event_Started    EventType = "started"
+	Event_Progress   EventType = "progress"
+	Event_Processing EventType = "processing" //post processor started or reported progress
+	Event_Broken     EventType = "broken"
+	Event_Retried    EventType = "retried"
+	Event_Deferred   EventType = "deferred"  //waiting for disk space
+	Event_Scheduled  EventType = "scheduled" //waiting for NotBefore
+	Event_Paused     EventType = "paused"
+	Event_Succeeded  EventType = "succeeded"
+	Event_Failed     EventType = "failed"
+	Event_Cancelled  EventType = "cancelled"
+)
+
+// DefaultEventBufferSize buffer of a subscriber if Subscribe with size <= 0
+const DefaultEventBufferSize = 256
+
+// TaskEvent Task is a copy, it does not change after the event is sent
+type TaskEvent struct {
+	Seq      uint64 //increase by 1 for every event of the manager
+	Type     EventType
+	Time     time.Time
+	UsedTime time.Duration //download time of this try, for progress event
+	Task     DownloadTask
+}
+
+// Subscription events are delivered in order, new events are dropped when C is full
+type Subscription struct {
+	C       <-chan TaskEvent
+	ch      chan TaskEvent
+	dropped uint64
+	m       *Manager
+}
+
+// Dropped count of events dropped because subscriber is too slow
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stop receiving events, C is closed
+func (s *Subscription) Close() {
+	s.m.eventLock.Lock()
+	defer s.m.eventLock.Unlock()
+	if _, exist := s.m.subscribers[s]; !exist {
+		return
+	}
+	delete(s.m.subscribers, s)
+	close(s.ch)
+}
+
+func (m *Manager) Subscribe(bufferSize int) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultEventBufferSize
+	}
+	ch := make(chan TaskEvent, bufferSize)
+	s := &Subscription{C: ch, ch: ch, m: m}
+
+	m.eventLock.Lock()
+	defer m.eventLock.Unlock()
+	m.subscribers[s] = struct{}{}
+	return s
+}
+
+func (m *Manager) publish(eventType EventType, task *DownloadTask, usedTime time.Duration) {
+	m.publishSnapshot(eventType, m.snapshotTask(task), usedTime)
+}
+
+// publishLocked is called with taskLock held
+func (m *Manager) publishLocked(eventType EventType, task *DownloadTask, usedTime time.Duration) {
+	snapshot := task.snapshot()
+	m.publishSnapshot(eventType, &snapshot, usedTime)
+}
+
+func (m *Manager) publishSnapshot(eventType EventType, snapshot *DownloadTask, usedTime time.Duration) {
+	m.eventLock.Lock()
+	defer m.eventLock.Unlock()
+	m.eventSeq++
+	if len(m.subscribers) == 0 {
+		return
+	}
+
+	event := TaskEvent{Seq: m.eventSeq, Type: eventType, Time: m.clock.Now(), UsedTime: usedTime, Task: *snapshot}
+	for s := range m.subscribers {
+		select {
+		case s.ch <- event:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// snapshotTask copy of task for callbacks and leveldb
+func (m *Manager) snapshotTask(task *DownloadTask) *DownloadTask {
+	m.taskLock.Lock()
+	defer m.taskLock.Unlock()
+	s := task.snapshot()
+	return &s
+}
+
+// snapshot copy of task which is not changed by download, taskLock must be held
+func (t *DownloadTask) snapshot() DownloadTask {
+	s := *t
+	s.Segments = nil
+	if len(t.Segments) > 0 {
+		s.Segments = cloneSegments(t.Segments)
+	}
+	s.runningChannel = nil
+	s.limiter = nil
+	return s
+}
@@ -0,0 +1,201 @@
+package downloadtaskmgr
+
+import (
+	"sort"
+	"time"
+)
+
+// EvictionCandidate a running task which may be broken to give its place to waiting tasks
+type EvictionCandidate struct {
+	TaskId         uint64
+	SpeedKBs       float64 //average since start
+	RecentSpeedKBs float64 //speed in the moving window, SpeedKBs if window is not full
+	Percent        float64 //-1 if file size unknown
+	RemainingSec   float64 //estimated by RecentSpeedKBs, -1 if unknown
+	RunningSec     int64
+	EvictTimes     int   //times the task was evicted before
+	MaxSpeedKBs    int64 //speed cap of task
+	Channel        int   //channel the task moves to, -1 means it is faster than all channels
+}
+
+// EvictionPolicy pick tasks to break when tasks are waiting in global queue
+type EvictionPolicy interface {
+	// SelectEvictions candidates are tasks which do not reach Config.MaxTaskEvictions, waiting is the global queue length
+	SelectEvictions(candidates []EvictionCandidate, waiting int) []EvictionCandidate
+}
+
+// DefaultEvictionPolicy evict slow tasks which are not close to finish
+type DefaultEvictionPolicy struct {
+	MaxEvictions        int     //at most evicted in one scan
+	MinRunningSec       int64   //new started task is not evicted
+	ProtectPercent      float64 //task finished more than this percent is not evicted
+	ProtectRemainingSec float64 //task will finish in this time is not evicted
+}
+
+func NewDefaultEvictionPolicy() *DefaultEvictionPolicy {
+	return &DefaultEvictionPolicy{
+		MaxEvictions:        3,
+		MinRunningSec:       10,
+		ProtectPercent:      70,
+		ProtectRemainingSec: 30,
+	}
+}
+
+func (p *DefaultEvictionPolicy) SelectEvictions(candidates []EvictionCandidate, waiting int) []EvictionCandidate {
+	selected := []EvictionCandidate{}
+	for _, v := range candidates {
+		if v.Channel < 0 || v.RunningSec < p.MinRunningSec {
+			continue
+		}
+		//limited by its own speed cap, not a slow task
+		if v.MaxSpeedKBs > 0 && v.RecentSpeedKBs >= float64(v.MaxSpeedKBs)*0.9 {
+			continue
+		}
+		if v.Percent >= p.ProtectPercent {
+			continue
+		}
+		if v.RemainingSec >= 0 && v.RemainingSec <= p.ProtectRemainingSec {
+			continue
+		}
+		selected = append(selected, v)
+	}
+
+	//task evicted fewer times and slower task go first
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].EvictTimes != selected[j].EvictTimes {
+			return selected[i].EvictTimes < selected[j].EvictTimes
+		}
+		return selected[i].RecentSpeedKBs < selected[j].RecentSpeedKBs
+	})
+	count := p.MaxEvictions
+	if waiting < count {
+		count = waiting
+	}
+	if len(selected) > count {
+		selected = selected[:count]
+	}
+	return selected
+}
+
+type speedSample struct {
+	time time.Time
+	size int64
+}
+
+// speedWindow samples of downloaded size in the last Config.SpeedWindowSec
+type speedWindow struct {
+	samples []speedSample
+}
+
+func (w *speedWindow) add(now time.Time, size int64, window time.Duration) {
+	//restarted from beginning
+	if len(w.samples) > 0 && size < w.samples[len(w.samples)-1].size {
+		w.samples = nil
+	}
+	w.samples = append(w.samples, speedSample{time: now, size: size})
+	//keep one sample older than window as base
+	for len(w.samples) > 2 && now.Sub(w.samples[1].time) >= window {
+		w.samples = w.samples[1:]
+	}
+}
+
+// speed KB/s, -1 if not enough samples
+func (w *speedWindow) speed() float64 {
+	if len(w.samples) < 2 {
+		return -1
+	}
+	first := w.samples[0]
+	last := w.samples[len(w.samples)-1]
+	sec := last.time.Sub(first.time).Seconds()
+	if sec < 1 {
+		return -1
+	}
+	return float64(last.size-first.size) / 1000 / sec
+}
+
+// SetEvictionPolicy nil means NewDefaultEvictionPolicy
+func (m *Manager) SetEvictionPolicy(policy EvictionPolicy) {
+	if policy == nil {
+		policy = NewDefaultEvictionPolicy()
+	}
+	m.evictLock.Lock()
+	m.evictionPolicy = policy
+	m.evictLock.Unlock()
+}
+
+// sampleSpeed record downloaded size of running tasks, it is called every scan even nothing is waiting
+func (m *Manager) sampleSpeed(now time.Time) map[uint64]float64 {
+	window := time.Duration(m.config.SpeedWindowSec) * time.Second
+	speeds := map[uint64]float64{}
+	running := map[uint64]bool{}
+	m.downloadingTaskMap.Range(func(key, value interface{}) bool {
+		task := value.(*DownloadTask)
+		running[task.Id] = true
+		w, exist := m.speedWindows[task.Id]
+		if !exist {
+			w = &speedWindow{}
+			m.speedWindows[task.Id] = w
+		}
+		m.taskLock.Lock()
+		downloaded := task.DownloadedSize
+		m.taskLock.Unlock()
+		w.add(now, downloaded, window)
+		speeds[task.Id] = w.speed()
+		return true
+	})
+	for id := range m.speedWindows {
+		if !running[id] {
+			delete(m.speedWindows, id)
+		}
+	}
+	return speeds
+}
+
+// evictionChannel the slowest channel which is faster than the task
+func (m *Manager) evictionChannel(speedKBs float64) int {
+	for i, v := range m.channelArray {
+		if speedKBs < float64(v.SpeedLimitKBs) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Manager) evictionCandidates(now time.Time, speeds map[uint64]float64) []EvictionCandidate {
+	candidates := []EvictionCandidate{}
+	m.downloadingTaskMap.Range(func(key, value interface{}) bool {
+		m.taskLock.Lock()
+		task := value.(*DownloadTask).snapshot()
+		m.taskLock.Unlock()
+		//not started downloading body, or file is downloaded already
+		if task.StartTime == 0 || task.PostProcessor != "" {
+			return true
+		}
+		if m.config.MaxTaskEvictions > 0 && task.EvictTimes >= m.config.MaxTaskEvictions {
+			return true
+		}
+		c := EvictionCandidate{
+			TaskId:         task.Id,
+			SpeedKBs:       task.SpeedKBs,
+			RecentSpeedKBs: speeds[task.Id],
+			Percent:        -1,
+			RemainingSec:   -1,
+			RunningSec:     now.Unix() - task.StartTime,
+			EvictTimes:     task.EvictTimes,
+			MaxSpeedKBs:    task.MaxSpeedKBs,
+		}
+		if c.RecentSpeedKBs < 0 {
+			c.RecentSpeedKBs = task.SpeedKBs
+		}
+		if task.FileSize > 0 {
+			c.Percent = float64(task.DownloadedSize) * 100 / float64(task.FileSize)
+			if c.RecentSpeedKBs > 0 {
+				c.RemainingSec = float64(task.FileSize-task.DownloadedSize) / 1000 / c.RecentSpeedKBs
+			}
+		}
+		c.Channel = m.evictionChannel(c.RecentSpeedKBs)
+		candidates = append(candidates, c)
+		return true
+	})
+	return candidates
+}
@@ -0,0 +1,59 @@
+package downloadtaskmgr
+
+// keepFailedTask remember a failed task so RetryTask can queue it again by id,
+// the oldest is dropped when more than Config.KeepFailedTasks are kept. They are not saved in leveldb.
+func (m *Manager) keepFailedTask(task *DownloadTask) {
+	if m.config.KeepFailedTasks < 0 {
+		return
+	}
+	m.failedLock.Lock()
+	defer m.failedLock.Unlock()
+	if _, exist := m.failedTasks[task.Id]; !exist {
+		m.failedOrder = append(m.failedOrder, task.Id)
+	}
+	m.failedTasks[task.Id] = task
+	for len(m.failedOrder) > m.config.KeepFailedTasks {
+		delete(m.failedTasks, m.failedOrder[0])
+		m.failedOrder = m.failedOrder[1:]
+	}
+}
+
+// takeFailedTask remove the failed task from kept list, nil if it is not kept
+func (m *Manager) takeFailedTask(id uint64) *DownloadTask {
+	m.failedLock.Lock()
+	defer m.failedLock.Unlock()
+	task, exist := m.failedTasks[id]
+	if !exist {
+		return nil
+	}
+	delete(m.failedTasks, id)
+	for i, v := range m.failedOrder {
+		if v == id {
+			m.failedOrder = append(m.failedOrder[:i:i], m.failedOrder[i+1:]...)
+			break
+		}
+	}
+	return task
+}
+
+// retryFailedTask queue a kept failed task again with the same id, it starts from beginning like a new task
+func (m *Manager) retryFailedTask(id uint64) error {
+	failed := m.takeFailedTask(id)
+	if failed == nil {
+		return ErrTaskNotExist
+	}
+	info := m.snapshotTask(failed).DownloadInfo
+	err := m.checkNewTasks([]*DownloadInfo{&info})
+	if err == nil {
+		task := &DownloadTask{}
+		task.Id = id
+		task.DownloadInfo = info
+		task.Status = Task_UnStart
+		err = m.saveNewTasks([]*DownloadTask{task}, nil)
+	}
+	if err != nil {
+		m.keepFailedTask(failed)
+		return err
+	}
+	return nil
+}
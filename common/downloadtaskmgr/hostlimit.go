@@ -0,0 +1,213 @@
+package downloadtaskmgr
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+// HostLimit limits of all tasks downloading from one origin host, 0 means unlimited
+type HostLimit struct {
+	MaxConnections int   //running tasks and extra segment connections
+	MaxSpeedKBs    int64 //speed cap of all tasks of the host
+}
+
+// hostKey tasks of BindName with its own HostLimit are counted apart from others
+type hostKey struct {
+	bindName string
+	host     string
+}
+
+type parkedTask struct {
+	task    *DownloadTask
+	channel *DownloadChannel
+}
+
+// hostState connections and waiting tasks of a host, guarded by hostLock
+type hostState struct {
+	limit       HostLimit
+	connections int
+	limiter     *RateLimiter
+	parked      []parkedTask
+}
+
+func sourceHost(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// hostKeyLocked return the key and limit of current source of task
+func (m *Manager) hostKeyLocked(task *DownloadTask) (hostKey, HostLimit) {
+	key := hostKey{host: sourceHost(task.source())}
+	if limit, exist := m.bindNameHostLimits[task.BindName]; exist {
+		key.bindName = task.BindName
+		return key, limit
+	}
+	return key, m.hostLimit
+}
+
+func (m *Manager) hostStateLocked(key hostKey, limit HostLimit) *hostState {
+	h, exist := m.hosts[key]
+	if !exist {
+		h = &hostState{limit: limit, limiter: NewRateLimiter(limit.MaxSpeedKBs)}
+		m.hosts[key] = h
+	}
+	return h
+}
+
+// acquireHost take a connection of task source host when task is taken out from queue.
+// If the host is full, the task is parked and queued again into channel with a connection kept for it
+// when a connection is released.
+func (m *Manager) acquireHost(task *DownloadTask, channel *DownloadChannel) bool {
+	m.hostLock.Lock()
+	defer m.hostLock.Unlock()
+	//connection kept when woken
+	if _, exist := m.taskHosts[task.Id]; exist {
+		return true
+	}
+	key, limit := m.hostKeyLocked(task)
+	if key.host == "" {
+		return true
+	}
+	h := m.hostStateLocked(key, limit)
+	if h.limit.MaxConnections > 0 && h.connections >= h.limit.MaxConnections {
+		//still counted as queued, so ResumeTask will not queue it twice
+		h.parked = append(h.parked, parkedTask{task: task, channel: channel})
+		logger.Debug("host connections full, park task", "id", task.Id, "host", key.host, "connections", h.connections)
+		return false
+	}
+	h.connections++
+	m.taskHosts[task.Id] = key
+	return true
+}
+
+// acquireHostConnections take at most n more connections for a running task without waiting, return the count taken
+func (m *Manager) acquireHostConnections(task *DownloadTask, n int) int {
+	m.hostLock.Lock()
+	defer m.hostLock.Unlock()
+	key, exist := m.taskHosts[task.Id]
+	if !exist {
+		return n
+	}
+	h := m.hosts[key]
+	if h.limit.MaxConnections > 0 && h.connections+n > h.limit.MaxConnections {
+		n = h.limit.MaxConnections - h.connections
+		if n < 0 {
+			n = 0
+		}
+	}
+	h.connections += n
+	return n
+}
+
+// releaseHostConnections give back n extra connections and wake parked tasks
+func (m *Manager) releaseHostConnections(task *DownloadTask, n int) {
+	m.releaseHostConnection(task, n, false)
+}
+
+// releaseHost is called after task stop running, or dropped from queue with a connection kept for it
+func (m *Manager) releaseHost(task *DownloadTask) {
+	m.releaseHostConnection(task, 1, true)
+}
+
+func (m *Manager) releaseHostConnection(task *DownloadTask, n int, done bool) {
+	m.hostLock.Lock()
+	key, exist := m.taskHosts[task.Id]
+	if !exist || n <= 0 {
+		m.hostLock.Unlock()
+		return
+	}
+	if done {
+		delete(m.taskHosts, task.Id)
+	}
+	h := m.hosts[key]
+	h.connections -= n
+	wake := m.wakeParkedLocked(key, h)
+	m.hostLock.Unlock()
+
+	for _, v := range wake {
+		m.queueTask(v.task, v.channel)
+	}
+}
+
+// wakeParkedLocked take out parked tasks which can get a connection now,
+// paused or cancelled tasks are taken out without connection and dropped by queueTask
+func (m *Manager) wakeParkedLocked(key hostKey, h *hostState) []parkedTask {
+	wake := []parkedTask{}
+	for len(h.parked) > 0 {
+		p := h.parked[0]
+		m.taskLock.Lock()
+		stopped := p.task.Status == Task_Paused || p.task.Status == Task_Cancelled || p.task.Status == Task_Expired
+		m.taskLock.Unlock()
+		if !stopped {
+			if h.limit.MaxConnections > 0 && h.connections >= h.limit.MaxConnections {
+				break
+			}
+			h.connections++
+			m.taskHosts[p.task.Id] = key
+		}
+		h.parked = h.parked[1:]
+		wake = append(wake, p)
+	}
+	if h.connections <= 0 && len(h.parked) == 0 {
+		delete(m.hosts, key)
+	}
+	return wake
+}
+
+// hostLimiter speed cap of the host which task is downloading from, nil if task holds no connection
+func (m *Manager) hostLimiter(task *DownloadTask) *RateLimiter {
+	m.hostLock.Lock()
+	defer m.hostLock.Unlock()
+	key, exist := m.taskHosts[task.Id]
+	if !exist {
+		return nil
+	}
+	return m.hosts[key].limiter
+}
+
+// SetHostLimit change the limit of every origin host at runtime, BindName with its own limit is not affected
+func (m *Manager) SetHostLimit(limit HostLimit) {
+	m.setHostLimit("", limit, false)
+}
+
+// SetBindNameHostLimit tasks of bindName are limited by their own host limit
+func (m *Manager) SetBindNameHostLimit(bindName string, limit HostLimit) {
+	m.setHostLimit(bindName, limit, false)
+}
+
+// RemoveBindNameHostLimit tasks of bindName go back to the common host limit after they stop running
+func (m *Manager) RemoveBindNameHostLimit(bindName string) {
+	m.setHostLimit(bindName, HostLimit{}, true)
+}
+
+func (m *Manager) setHostLimit(bindName string, limit HostLimit, remove bool) {
+	m.hostLock.Lock()
+	switch {
+	case bindName == "":
+		m.hostLimit = limit
+	case remove:
+		delete(m.bindNameHostLimits, bindName)
+	default:
+		m.bindNameHostLimits[bindName] = limit
+	}
+
+	wake := []parkedTask{}
+	for key, h := range m.hosts {
+		if key.bindName != bindName {
+			continue
+		}
+		h.limit = limit
+		h.limiter.SetLimit(limit.MaxSpeedKBs)
+		wake = append(wake, m.wakeParkedLocked(key, h)...)
+	}
+	m.hostLock.Unlock()
+
+	for _, v := range wake {
+		m.queueTask(v.task, v.channel)
+	}
+}
@@ -3,18 +3,28 @@ package downloadtaskmgr
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
 	"github.com/daqnext/meson-common/common/logger"
 	"github.com/daqnext/meson-common/common/runpath"
 	"github.com/daqnext/meson-common/common/utils"
 	"github.com/syndtr/goleveldb/leveldb"
-	"os"
-	"path/filepath"
-	"sync"
 )
 
+// LDBPath leveldb folder of the default manager
 var LDBPath = filepath.Join(runpath.RunPath, "./downloadldb")
+
+// LDBFile leveldb of the default manager.
+//
+// Deprecated: the default manager opens "index" under LDBPath when InitTaskMgr is called.
 var LDBFile = filepath.Join(runpath.RunPath, "./downloadldb/index")
 
+// LevelDBInit create LDBPath.
+//
+// Deprecated: InitTaskMgr creates it.
 func LevelDBInit() {
 	if !utils.Exists(LDBPath) {
 		err := os.Mkdir(LDBPath, 0777)
@@ -24,69 +34,88 @@ func LevelDBInit() {
 	}
 }
 
+// DBLock was held around every leveldb access.
+//
+// Deprecated: the manager serializes leveldb access itself, DBLock is not used.
 var DBLock sync.Mutex
 
+// OpenDB open LDBFile, the caller closes it.
+//
+// Deprecated: the default manager keeps its leveldb open from InitTaskMgr to CloseLDB, OpenDB fails with the file locked meanwhile.
+// Use SetTaskToLDB, DelTaskFromLDB and LoopTasksInLDB.
 func OpenDB() (*leveldb.DB, error) {
-	db, err := leveldb.OpenFile(LDBFile, nil)
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
+	return leveldb.OpenFile(LDBFile, nil)
 }
 
-func SetTaskToLDB(task *DownloadTask) {
-	b := make([]byte, binary.MaxVarintLen64)
-	binary.LittleEndian.PutUint64(b, task.Id)
-	DBLock.Lock()
-	defer DBLock.Unlock()
-	db, err := OpenDB()
-	if err != nil {
-		logger.Error("SetTask open level db error", "err", err)
-		return
-	}
-	defer db.Close()
+var ErrTaskStoreClosed = errors.New("task store is not open")
 
-	taskStr, err := json.Marshal(task)
-	if err != nil {
-		logger.Error("SetTask json.Marshal error", "taskId", task.Id)
-		return
-	}
-	//fmt.Println(string(taskStr))
+// taskStore keep the leveldb open during the whole life of manager
+type taskStore struct {
+	lock sync.RWMutex
+	db   *leveldb.DB
+}
 
-	err = db.Put(b, taskStr, nil)
+func openTaskStore(dbPath string) (*taskStore, error) {
+	if !utils.Exists(dbPath) {
+		err := os.MkdirAll(dbPath, 0777)
+		if err != nil {
+			return nil, errors.New("file dir create failed, please create dir " + dbPath + " by manual")
+		}
+	}
+	db, err := leveldb.OpenFile(filepath.Join(dbPath, "index"), nil)
 	if err != nil {
-		logger.Error("leveldb put data error", "err", err, "taskStr", taskStr)
+		return nil, err
 	}
+	return &taskStore{db: db}, nil
 }
 
-func DelTaskFromLDB(taskId uint64) {
+func taskKey(taskId uint64) []byte {
 	b := make([]byte, binary.MaxVarintLen64)
 	binary.LittleEndian.PutUint64(b, taskId)
-	DBLock.Lock()
-	defer DBLock.Unlock()
-	db, err := OpenDB()
-	if err != nil {
-		logger.Error("DelTask open level db error", "err", err)
-		return
+	return b
+}
+
+func (s *taskStore) put(task *DownloadTask) error {
+	return s.putBatch([]*DownloadTask{task})
+}
+
+// putBatch write all tasks in one leveldb batch
+func (s *taskStore) putBatch(tasks []*DownloadTask) error {
+	batch := new(leveldb.Batch)
+	for _, v := range tasks {
+		taskStr, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		batch.Put(taskKey(v.Id), taskStr)
 	}
-	defer db.Close()
 
-	err = db.Delete(b, nil)
-	if err != nil {
-		logger.Error("DelTask from level db error", "err", err)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.db == nil {
+		return ErrTaskStoreClosed
 	}
+	return s.db.Write(batch, nil)
 }
 
-func LoopTasksInLDB() []*DownloadTask {
-	DBLock.Lock()
-	defer DBLock.Unlock()
-	db, err := OpenDB()
-	if err != nil {
-		logger.Error("LoopTasksInDB open level db error", "err", err)
-		return nil
+func (s *taskStore) delete(taskId uint64) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.db == nil {
+		return ErrTaskStoreClosed
+	}
+	return s.db.Delete(taskKey(taskId), nil)
+}
+
+func (s *taskStore) loop() ([]*DownloadTask, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.db == nil {
+		return nil, ErrTaskStoreClosed
 	}
-	defer db.Close()
-	iter := db.NewIterator(nil, nil)
+
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
 	tasks := []*DownloadTask{}
 	for iter.Next() {
 		// Remember that the contents of the returned slice should not be modified, and
@@ -101,10 +130,89 @@ func LoopTasksInLDB() []*DownloadTask {
 		}
 		tasks = append(tasks, &task)
 	}
-	iter.Release()
-	err = iter.Error()
+	return tasks, iter.Error()
+}
+
+func (s *taskStore) close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+// SetTaskToLDB save a snapshot of task, it must not be called with taskLock held
+func (m *Manager) SetTaskToLDB(task *DownloadTask) error {
+	if m.store == nil {
+		return ErrTaskStoreClosed
+	}
+	err := m.store.put(m.snapshotTask(task))
 	if err != nil {
-		logger.Error("loop iter error", "err", err)
+		logger.Error("SetTask to level db error", "err", err, "taskId", task.Id)
+	}
+	return err
+}
+
+// setTaskToLDBLocked is called with taskLock held
+func (m *Manager) setTaskToLDBLocked(task *DownloadTask) error {
+	if m.store == nil {
+		return ErrTaskStoreClosed
+	}
+	snapshot := task.snapshot()
+	err := m.store.put(&snapshot)
+	if err != nil {
+		logger.Error("SetTask to level db error", "err", err, "taskId", task.Id)
+	}
+	return err
+}
+
+func (m *Manager) SetTasksToLDB(tasks []*DownloadTask) error {
+	if m.store == nil {
+		return ErrTaskStoreClosed
+	}
+	snapshots := []*DownloadTask{}
+	m.taskLock.Lock()
+	for _, v := range tasks {
+		snapshot := v.snapshot()
+		snapshots = append(snapshots, &snapshot)
+	}
+	m.taskLock.Unlock()
+	err := m.store.putBatch(snapshots)
+	if err != nil {
+		logger.Error("SetTasks to level db error", "err", err, "count", len(tasks))
+	}
+	return err
+}
+
+func (m *Manager) DelTaskFromLDB(taskId uint64) error {
+	if m.store == nil {
+		return ErrTaskStoreClosed
+	}
+	err := m.store.delete(taskId)
+	if err != nil {
+		logger.Error("DelTask from level db error", "err", err, "taskId", taskId)
+	}
+	return err
+}
+
+func (m *Manager) LoopTasksInLDB() ([]*DownloadTask, error) {
+	if m.store == nil {
+		return nil, ErrTaskStoreClosed
+	}
+	tasks, err := m.store.loop()
+	if err != nil {
+		logger.Error("loop level db error", "err", err)
+	}
+	return tasks, err
+}
+
+// CloseLDB flush and close leveldb, manager can not save tasks after closed
+func (m *Manager) CloseLDB() error {
+	if m.store == nil {
+		return nil
 	}
-	return tasks
+	return m.store.close()
 }
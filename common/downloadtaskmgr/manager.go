@@ -0,0 +1,225 @@
+package downloadtaskmgr
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type ChannelConfig struct {
+	SpeedLimitKBs int64 //task slower than this will be moved into this channel
+	CountLimit    int   //running task count
+	IdleQueueSize int
+	MaxSpeedKBs   int64 //speed cap of all tasks running in this channel, 0 means unlimited
+}
+
+type Config struct {
+	Channels                 []ChannelConfig
+	NewRunningTaskCount      int
+	GlobalQueueSize          int                  //max waiting new tasks
+	PriorityWeights          map[TaskPriority]int //nil means DefaultPriorityWeights
+	RetryPolicy              RetryPolicy          //how failed tasks are retried
+	DBPath                   string               //leveldb folder
+	SegmentDownloadThreshold int64
+	SegmentCount             int
+	//speed caps, 0 means unlimited
+	MaxSpeedKBs        int64 //all tasks of the manager
+	NewTaskMaxSpeedKBs int64 //tasks running from global queue
+	//disk space
+	MinFreeSpace         uint64        //bytes kept free on filesystem of SavePath
+	NoSpaceRetryInterval time.Duration //task waiting for disk space is tried again after this, 0 means 1 minute
+	DedupByTargetUrl     bool          //tasks of the same TargetUrl are duplicated even saved to different paths
+	CleanTempFiles       bool          //remove stale temp files under rootPath in Init, only if no other manager saves files under it, InitTaskMgr turns it on
+	KeepFailedTasks      int           //recently failed tasks kept in memory for RetryTask, 0 means 100, negative keeps none
+	//task with more sources moves to next source if slower than SlowSourceKBs after running SlowSourceCheckSec
+	SlowSourceKBs      int64
+	SlowSourceCheckSec int64
+	//eviction of slow tasks
+	EvictionPolicy   EvictionPolicy //nil means NewDefaultEvictionPolicy
+	MaxTaskEvictions int            //a task is not evicted again after so many times, 0 means no limit
+	SpeedWindowSec   int            //moving window of recent speed
+	Clock            Clock          //nil means RealClock
+	//origin host limits, host is taken from the url of current source
+	HostLimit          HostLimit
+	BindNameHostLimits map[string]HostLimit //tasks of these BindName use their own limit
+	Transport          TransportConfig
+	PostProcessors     []PostProcessor //run in order before a task is reported successful
+	BandwidthSchedule  *BandwidthSchedule
+}
+
+// DefaultConfig is the config of the package level default manager
+func DefaultConfig() Config {
+	return Config{
+		Channels: []ChannelConfig{
+			{SpeedLimitKBs: 30, CountLimit: ChannelRunningSize[0], IdleQueueSize: 1024 * 5},   //30KB/s
+			{SpeedLimitKBs: 100, CountLimit: ChannelRunningSize[1], IdleQueueSize: 1024 * 5},  //100KB/s
+			{SpeedLimitKBs: 500, CountLimit: ChannelRunningSize[2], IdleQueueSize: 1024 * 5},  //500KB/s
+			{SpeedLimitKBs: 1500, CountLimit: ChannelRunningSize[3], IdleQueueSize: 1024 * 3}, //1500KB/s
+			{SpeedLimitKBs: 2500, CountLimit: ChannelRunningSize[4], IdleQueueSize: 1024 * 3}, //2500KB/s
+		},
+		NewRunningTaskCount:      NewRunningTaskCount,
+		GlobalQueueSize:          GlobalDownloadTaskChanSize,
+		RetryPolicy:              DefaultRetryPolicy(),
+		DBPath:                   LDBPath,
+		SegmentDownloadThreshold: SegmentDownloadThreshold,
+		SegmentCount:             SegmentCount,
+		NoSpaceRetryInterval:     time.Minute,
+		SlowSourceKBs:            10,
+		SlowSourceCheckSec:       30,
+		MaxTaskEvictions:         3,
+		SpeedWindowSec:           30,
+	}
+}
+
+// Manager is an independent download queue, tasks are saved in its own leveldb
+type Manager struct {
+	config Config
+	clock  Clock
+
+	currentId uint64
+	idLock    sync.Mutex
+
+	scheduler                 *taskScheduler
+	newRunningTaskControlChan chan bool
+	channelArray              []*DownloadChannel
+	downloadingTaskMap        *sync.Map
+	globalLimiter             *RateLimiter
+	newTaskLimiter            *RateLimiter
+
+	speedLock         sync.Mutex
+	maxSpeedKBs       int64 //set by config or SetMaxSpeed, globalLimiter is this scaled by bandwidthSchedule
+	bandwidthSchedule *BandwidthSchedule
+
+	clientLock sync.Mutex
+	client     *http.Client //shared by all tasks, replaced by SetTransportConfig
+
+	//all unfinished tasks
+	taskMap     sync.Map
+	taskLock    sync.Mutex
+	queuedTasks map[uint64]*DownloadChannel //nil channel means global queue or waiting for retry
+	retryTimers map[uint64]Timer
+	runs        map[uint64]*taskRun
+
+	spaceLock    sync.Mutex
+	reservations map[uint64]*spaceReservation
+
+	//queued or running tasks by SavePath and TargetUrl
+	dedupLock     sync.Mutex
+	dedupIndex    map[string]uint64
+	doneCallbacks map[uint64][]TaskDoneCallback
+
+	//connections of origin hosts
+	hostLock           sync.Mutex
+	hostLimit          HostLimit
+	bindNameHostLimits map[string]HostLimit
+	hosts              map[hostKey]*hostState
+	taskHosts          map[uint64]hostKey //connection taken by task
+
+	postLock       sync.Mutex
+	postProcessors []PostProcessor
+
+	evictLock      sync.Mutex
+	evictionPolicy EvictionPolicy
+	speedWindows   map[uint64]*speedWindow
+
+	//recently failed tasks, oldest first
+	failedLock  sync.Mutex
+	failedTasks map[uint64]*DownloadTask
+	failedOrder []uint64
+
+	eventLock   sync.Mutex
+	eventSeq    uint64
+	subscribers map[*Subscription]struct{}
+
+	onTaskSuccess   func(task *DownloadTask)
+	onTaskFailed    func(task *DownloadTask)
+	panicCatcher    func()
+	onDownloadStart func(task *DownloadTask)
+	onDownloading   func(task *DownloadTask, usedTimeSec int)
+
+	store *taskStore
+
+	//shutdown
+	closing  bool //guarded by taskLock
+	stopChan chan struct{}
+	loopWg   sync.WaitGroup //dispatch loops
+	taskWg   sync.WaitGroup //running tasks
+}
+
+// NewManager channels should be sorted by SpeedLimitKBs from slow to fast
+func NewManager(config Config) *Manager {
+	m := &Manager{
+		config:             config,
+		downloadingTaskMap: &sync.Map{},
+		queuedTasks:        map[uint64]*DownloadChannel{},
+		retryTimers:        map[uint64]Timer{},
+		runs:               map[uint64]*taskRun{},
+		reservations:       map[uint64]*spaceReservation{},
+		dedupIndex:         map[string]uint64{},
+		doneCallbacks:      map[uint64][]TaskDoneCallback{},
+		subscribers:        map[*Subscription]struct{}{},
+		speedWindows:       map[uint64]*speedWindow{},
+		failedTasks:        map[uint64]*DownloadTask{},
+		hostLimit:          config.HostLimit,
+		hosts:              map[hostKey]*hostState{},
+		taskHosts:          map[uint64]hostKey{},
+		stopChan:           make(chan struct{}),
+	}
+	//0 would queue a task short of space again at once
+	if m.config.NoSpaceRetryInterval <= 0 {
+		m.config.NoSpaceRetryInterval = time.Minute
+	}
+	//zero value RetryPolicy retries like DefaultRetryPolicy
+	if m.config.RetryPolicy.MaxAttempts <= 0 {
+		m.config.RetryPolicy.MaxAttempts = DefaultRetryPolicy().MaxAttempts
+	}
+	if m.config.RetryPolicy.RetryableStatus == nil {
+		m.config.RetryPolicy.RetryableStatus = DefaultRetryPolicy().RetryableStatus
+	}
+	if m.config.KeepFailedTasks == 0 {
+		m.config.KeepFailedTasks = 100
+	}
+	m.clock = config.Clock
+	if m.clock == nil {
+		m.clock = RealClock{}
+	}
+	m.bindNameHostLimits = map[string]HostLimit{}
+	for k, v := range config.BindNameHostLimits {
+		m.bindNameHostLimits[k] = v
+	}
+	m.postProcessors = append([]PostProcessor{}, config.PostProcessors...)
+	m.evictionPolicy = config.EvictionPolicy
+	if m.evictionPolicy == nil {
+		m.evictionPolicy = NewDefaultEvictionPolicy()
+	}
+	m.scheduler = newTaskScheduler(config.PriorityWeights)
+	m.maxSpeedKBs = config.MaxSpeedKBs
+	m.bandwidthSchedule = config.BandwidthSchedule
+	m.globalLimiter = NewRateLimiter(config.MaxSpeedKBs)
+	m.newTaskLimiter = NewRateLimiter(config.NewTaskMaxSpeedKBs)
+
+	m.newRunningTaskControlChan = make(chan bool, config.NewRunningTaskCount)
+	for i := 0; i < config.NewRunningTaskCount; i++ {
+		m.newRunningTaskControlChan <- true
+	}
+
+	for _, v := range config.Channels {
+		channel := &DownloadChannel{
+			SpeedLimitKBs:           v.SpeedLimitKBs,
+			CountLimit:              v.CountLimit,
+			RunningCountControlChan: make(chan bool, v.CountLimit),
+			IdleChan:                make(chan *DownloadTask, v.IdleQueueSize),
+			limiter:                 NewRateLimiter(v.MaxSpeedKBs),
+			manager:                 m,
+		}
+		for i := 0; i < channel.CountLimit; i++ {
+			channel.RunningCountControlChan <- true
+		}
+		m.channelArray = append(m.channelArray, channel)
+	}
+	return m
+}
+
+func (m *Manager) Config() Config {
+	return m.config
+}
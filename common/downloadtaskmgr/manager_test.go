@@ -0,0 +1,1039 @@
+package downloadtaskmgr_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daqnext/meson-common/common/downloadtaskmgr"
+	"github.com/daqnext/meson-common/common/downloadtaskmgr/dltest"
+)
+
+const waitTimeout = 10 * time.Second
+
+type testEnv struct {
+	t      *testing.T
+	dir    string
+	clock  *dltest.FakeClock
+	origin *dltest.Origin
+	config downloadtaskmgr.Config
+	setup  func(m *downloadtaskmgr.Manager) //called by start before Run
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir("", "downloadtaskmgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := dltest.NewFakeClock(time.Unix(1600000000, 0))
+	e := &testEnv{t: t, dir: dir, clock: clock, origin: dltest.NewOrigin(), config: dltest.Config(dir, clock)}
+	t.Cleanup(func() {
+		e.origin.Close()
+		os.RemoveAll(dir)
+	})
+	return e
+}
+
+// start a manager on env dir, it is shut down when test ends
+func (e *testEnv) start() (*downloadtaskmgr.Manager, *downloadtaskmgr.Subscription) {
+	m := downloadtaskmgr.NewManager(e.config)
+	err := m.Init(e.dir)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if e.setup != nil {
+		e.setup(m)
+	}
+	sub := m.Subscribe(1024)
+	m.Run()
+	e.t.Cleanup(func() {
+		sub.Close()
+		//stalled bodies would block shutdown
+		e.origin.Release()
+		m.Shutdown(context.Background())
+	})
+	//scan loop is ready for Advance
+	if !e.clock.WaitTickers(1, waitTimeout) {
+		e.t.Fatal("scan loop not started")
+	}
+	return m, sub
+}
+
+func (e *testEnv) savePath(name string) string {
+	return filepath.Join(e.dir, "files", name)
+}
+
+func (e *testEnv) add(m *downloadtaskmgr.Manager, url string, name string) uint64 {
+	id, err := m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: url, SavePath: e.savePath(name)})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return id
+}
+
+func (e *testEnv) wait(sub *downloadtaskmgr.Subscription, id uint64, eventType downloadtaskmgr.EventType) downloadtaskmgr.TaskEvent {
+	ev, ok := dltest.WaitEvent(sub, waitTimeout, dltest.IsEvent(id, eventType))
+	if !ok {
+		e.t.Fatalf("task %d: no %s event", id, eventType)
+	}
+	return ev
+}
+
+// waitSucceeded waits until all tasks succeeded in any order
+func (e *testEnv) waitSucceeded(sub *downloadtaskmgr.Subscription, ids ...uint64) map[uint64]downloadtaskmgr.TaskEvent {
+	events := map[uint64]downloadtaskmgr.TaskEvent{}
+	left := map[uint64]bool{}
+	for _, id := range ids {
+		left[id] = true
+	}
+	for len(left) > 0 {
+		ev, ok := dltest.WaitEvent(sub, waitTimeout, func(ev downloadtaskmgr.TaskEvent) bool {
+			return left[ev.Task.Id] && ev.Type == downloadtaskmgr.Event_Succeeded
+		})
+		if !ok {
+			e.t.Fatalf("tasks %v: no succeeded event", left)
+		}
+		delete(left, ev.Task.Id)
+		events[ev.Task.Id] = ev
+	}
+	return events
+}
+
+func (e *testEnv) checkFile(name string, data []byte) {
+	content, err := ioutil.ReadFile(e.savePath(name))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	if !bytes.Equal(content, data) {
+		e.t.Fatalf("%s: content not match, size %d want %d", name, len(content), len(data))
+	}
+	if _, err := os.Stat(e.savePath(name) + downloadtaskmgr.TempFileMark); !os.IsNotExist(err) {
+		e.t.Fatalf("%s: temp file left", name)
+	}
+}
+
+func TestDownloadSuccess(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.SegmentDownloadThreshold = 8 * 1024 * 1024
+	m, sub := e.start()
+
+	small := dltest.RandomData(100 * 1000)
+	big := dltest.RandomData(9 * 1024 * 1024)
+	smallId := e.add(m, e.origin.Add("small", dltest.File{Data: small, ETag: `"small"`}), "small")
+	bigId := e.add(m, e.origin.Add("big", dltest.File{Data: big, ETag: `"big"`}), "big")
+
+	events := e.waitSucceeded(sub, smallId, bigId)
+	ev := events[smallId]
+	if ev.Task.DownloadedSize != int64(len(small)) || ev.Task.TryTimes != 0 {
+		t.Fatal("small", ev.Task.DownloadedSize, ev.Task.TryTimes)
+	}
+	e.checkFile("small", small)
+
+	ev = events[bigId]
+	if len(ev.Task.Segments) < 2 {
+		t.Fatal("big file not segmented", len(ev.Task.Segments))
+	}
+	e.checkFile("big", big)
+	if m.GetTask(smallId) != nil || m.GetTask(bigId) != nil {
+		t.Fatal("finished task left")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	e := newTestEnv(t)
+	m, sub := e.start()
+
+	data := dltest.RandomData(10 * 1000)
+	id := e.add(m, e.origin.Add("busy", dltest.File{Data: data, ErrorStatus: 503, ErrorTimes: 2}), "busy")
+	for i := 1; i <= 2; i++ {
+		ev := e.wait(sub, id, downloadtaskmgr.Event_Retried)
+		if ev.Task.TryTimes != i || ev.Task.FailStatusCode != 503 {
+			t.Fatal("retry", i, ev.Task.TryTimes, ev.Task.FailStatusCode)
+		}
+		//waiting for backoff
+		if !e.clock.WaitTimers(1, waitTimeout) {
+			t.Fatal("retry timer not set")
+		}
+		e.clock.Advance(e.config.RetryPolicy.MaxBackoff)
+	}
+	ev := e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	if ev.Task.TryTimes != 2 {
+		t.Fatal("tryTimes", ev.Task.TryTimes)
+	}
+	e.checkFile("busy", data)
+
+	//permanent error is not retried
+	id = e.add(m, e.origin.URL+"/missing", "missing")
+	ev, _ = dltest.WaitEvent(sub, waitTimeout, func(ev downloadtaskmgr.TaskEvent) bool {
+		return ev.Task.Id == id && (ev.Type == downloadtaskmgr.Event_Failed || ev.Type == downloadtaskmgr.Event_Retried)
+	})
+	if ev.Type != downloadtaskmgr.Event_Failed || ev.Task.FailStatusCode != 404 {
+		t.Fatal("404", ev.Type, ev.Task.FailStatusCode)
+	}
+
+	//failed task is queued again by id
+	e.origin.Add("missing", dltest.File{Data: data})
+	err := m.RetryTask(id)
+	if err != nil {
+		t.Fatal("retry failed task", err)
+	}
+	ev = e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	if ev.Task.TryTimes != 0 || ev.Task.FailStatusCode != 0 {
+		t.Fatal("retried", ev.Task.TryTimes, ev.Task.FailStatusCode)
+	}
+	e.checkFile("missing", data)
+	if m.RetryTask(id) != downloadtaskmgr.ErrTaskNotExist {
+		t.Fatal("succeeded task retried")
+	}
+}
+
+func TestZeroRetryPolicy(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.RetryPolicy = downloadtaskmgr.RetryPolicy{}
+	m, sub := e.start()
+
+	data := dltest.RandomData(10 * 1000)
+	id := e.add(m, e.origin.Add("busy", dltest.File{Data: data, ErrorStatus: 503, ErrorTimes: 2}), "busy")
+	ev := e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	if ev.Task.TryTimes != 2 {
+		t.Fatal("tryTimes", ev.Task.TryTimes)
+	}
+	e.checkFile("busy", data)
+}
+
+func TestBreakToIdleChannel(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.NewRunningTaskCount = 1
+	m, sub := e.start()
+
+	stallAt := int64(64 * 1024)
+	slowData := dltest.RandomData(1000 * 1000)
+	slowId := e.add(m, e.origin.Add("slow", dltest.File{Data: slowData, ETag: `"slow"`, StallAfter: stallAt}), "slow")
+	e.wait(sub, slowId, downloadtaskmgr.Event_Started)
+	//only one new task runs, this one waits in global queue
+	data := dltest.RandomData(10 * 1000)
+	id := e.add(m, e.origin.Add("fast", dltest.File{Data: data}), "fast")
+
+	//scan loop and speed monitor
+	if !e.clock.WaitTickers(2, waitTimeout) {
+		t.Fatal("speed monitor not started")
+	}
+	for i := 0; i < 10; i++ {
+		e.clock.Advance(downloadtaskmgr.SpeedInterval)
+		e.wait(sub, slowId, downloadtaskmgr.Event_Progress)
+	}
+	ev := e.wait(sub, slowId, downloadtaskmgr.Event_Broken)
+	if ev.Task.BreakReason != downloadtaskmgr.StopReason_Evicted || ev.Task.EvictTimes != 1 || ev.Task.DownloadedSize != stallAt {
+		t.Fatal("break", ev.Task.BreakReason, ev.Task.EvictTimes, ev.Task.DownloadedSize)
+	}
+
+	//evicted task goes to the slowest channel and resumes from where it stopped
+	e.wait(sub, slowId, downloadtaskmgr.Event_Queued)
+	found := false
+	for _, v := range m.ListTasks() {
+		if v.Task.Id == slowId {
+			found = true
+			if v.Channel != 0 {
+				t.Fatal("channel", v.State, v.Channel)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("evicted task not listed")
+	}
+	e.waitSucceeded(sub, id, slowId)
+	e.checkFile("slow", slowData)
+	e.checkFile("fast", data)
+
+	requests := e.origin.Requests("slow")
+	last := requests[len(requests)-1]
+	if last.Range != "bytes=65536-" {
+		t.Fatal("not resumed", last.Range)
+	}
+}
+
+func TestRestartRecovery(t *testing.T) {
+	e := newTestEnv(t)
+	stallAt := int64(64 * 1024)
+	data := dltest.RandomData(200 * 1000)
+	url := e.origin.Add("file", dltest.File{Data: data, ETag: `"file"`, StallAfter: stallAt})
+
+	m := downloadtaskmgr.NewManager(e.config)
+	err := m.Init(e.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := m.Subscribe(1024)
+	m.Run()
+	id := e.add(m, url, "file")
+	e.wait(sub, id, downloadtaskmgr.Event_Started)
+	//validators are saved when body starts
+	tasks, err := m.LoopTasksInLDB()
+	if err != nil || len(tasks) != 1 || tasks[0].ETag != `"file"` {
+		t.Fatal("record", tasks, err)
+	}
+
+	//running task is interrupted and saved when shutdown times out
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = m.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatal("shutdown", err)
+	}
+	ev := e.wait(sub, id, downloadtaskmgr.Event_Broken)
+	if ev.Task.BreakReason != downloadtaskmgr.StopReason_Shutdown || ev.Task.DownloadedSize != stallAt {
+		t.Fatal("break", ev.Task.BreakReason, ev.Task.DownloadedSize)
+	}
+
+	m, sub = e.start()
+	restored := m.GetTask(id)
+	if restored == nil {
+		t.Fatal("task not restored")
+	}
+	//copy of task, download is not affected
+	restored.SavePath = ""
+	ev = e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	if ev.Task.DownloadedSize != int64(len(data)) {
+		t.Fatal("size", ev.Task.DownloadedSize)
+	}
+	e.checkFile("file", data)
+	requests := e.origin.Requests("file")
+	if last := requests[len(requests)-1]; last.Range != "bytes=65536-" {
+		t.Fatal("not resumed", last.Range)
+	}
+
+	//new id is after restored one
+	newId := e.add(m, e.origin.Add("next", dltest.File{Data: data}), "next")
+	if newId <= id {
+		t.Fatal("id reused", newId, id)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	e := newTestEnv(t)
+	m := downloadtaskmgr.NewManager(e.config)
+	err := m.Init(e.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := m.Subscribe(1024)
+	m.Run()
+
+	//running task finishes before shutdown returns
+	data := dltest.RandomData(20 * 1000)
+	id := e.add(m, e.origin.Add("slow", dltest.File{Data: data, BytesPerSec: 40 * 1000}), "slow")
+	e.wait(sub, id, downloadtaskmgr.Event_Started)
+	err = m.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	e.checkFile("slow", data)
+
+	_, err = m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: e.origin.URL + "/slow", SavePath: e.savePath("again")})
+	if err != downloadtaskmgr.ErrManagerClosed {
+		t.Fatal("add after shutdown", err)
+	}
+	if m.Shutdown(context.Background()) != downloadtaskmgr.ErrManagerClosed {
+		t.Fatal("shutdown twice")
+	}
+}
+
+func TestShutdownWhileFailing(t *testing.T) {
+	e := newTestEnv(t)
+	m := downloadtaskmgr.NewManager(e.config)
+	err := m.Init(e.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Run()
+
+	//origin answers 503 after shutdown started
+	requested := make(chan struct{}, 10)
+	fail := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-fail
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer origin.Close()
+	id := e.add(m, origin.URL+"/file", "file")
+	<-requested
+
+	done := make(chan error)
+	go func() {
+		done <- m.Shutdown(context.Background())
+	}()
+	for {
+		_, err := m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: origin.URL + "/other", SavePath: e.savePath("other")})
+		if err == downloadtaskmgr.ErrManagerClosed {
+			break
+		}
+		if err != nil && !errors.Is(err, downloadtaskmgr.ErrTaskExist) {
+			t.Fatal("add", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(fail)
+	err = <-done
+	if err != nil {
+		t.Fatal("shutdown", err)
+	}
+
+	//retry is not waiting after shutdown, the task is queued again after restart
+	if e.clock.Timers() != 0 {
+		t.Fatal("retry timer left", e.clock.Timers())
+	}
+	m = downloadtaskmgr.NewManager(e.config)
+	err = m.Init(e.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, err := m.LoopTasksInLDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, v := range tasks {
+		if v.Id == id {
+			found = v.TryTimes == 1 && v.Status == downloadtaskmgr.Task_UnStart
+		}
+	}
+	if !found {
+		t.Fatal("record", tasks)
+	}
+	m.Shutdown(context.Background())
+}
+
+func TestPostProcess(t *testing.T) {
+	e := newTestEnv(t)
+	release := make(chan struct{})
+	order := []string{}
+	e.config.PostProcessors = []downloadtaskmgr.PostProcessor{
+		downloadtaskmgr.NewPostProcessor("hash", func(ctx context.Context, task *downloadtaskmgr.DownloadTask, filePath string, report func(percent float64)) error {
+			order = append(order, "hash")
+			if filePath != task.SavePath+downloadtaskmgr.TempFileMark {
+				return errors.New("not temp file " + filePath)
+			}
+			report(50)
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}),
+		downloadtaskmgr.NewPostProcessor("index", func(ctx context.Context, task *downloadtaskmgr.DownloadTask, filePath string, report func(percent float64)) error {
+			order = append(order, "index")
+			if filepath.Base(task.SavePath) == "bad" {
+				return errors.New("index full")
+			}
+			return nil
+		}),
+	}
+	m, sub := e.start()
+
+	data := dltest.RandomData(10 * 1000)
+	id := e.add(m, e.origin.Add("good", dltest.File{Data: data}), "good")
+	ev, _ := dltest.WaitEvent(sub, waitTimeout, func(ev downloadtaskmgr.TaskEvent) bool {
+		return ev.Task.Id == id && ev.Type == downloadtaskmgr.Event_Processing && ev.Task.PostProcessPercent == 50
+	})
+	if ev.Task.PostProcessor != "hash" {
+		t.Fatal("processor", ev.Task.PostProcessor)
+	}
+	//not reported finished before processed
+	list := m.ListTasks()
+	if len(list) != 1 || list[0].State != downloadtaskmgr.TaskState_Processing {
+		t.Fatal("state", list)
+	}
+	if _, err := os.Stat(e.savePath("good")); !os.IsNotExist(err) {
+		t.Fatal("file appears before processed")
+	}
+
+	//paused while processing, downloaded file is kept and processed again after resumed
+	err := m.PauseTask(id)
+	if err != nil {
+		t.Fatal("pause", err)
+	}
+	e.wait(sub, id, downloadtaskmgr.Event_Paused)
+	err = m.ResumeTask(id)
+	if err != nil {
+		t.Fatal("resume", err)
+	}
+	_, ok := dltest.WaitEvent(sub, waitTimeout, func(ev downloadtaskmgr.TaskEvent) bool {
+		return ev.Task.Id == id && ev.Type == downloadtaskmgr.Event_Processing && ev.Task.PostProcessPercent == 50
+	})
+	if !ok {
+		t.Fatal("not processed again")
+	}
+	close(release)
+	ev = e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	if ev.Task.PostProcessor != "" {
+		t.Fatal("processor left", ev.Task.PostProcessor)
+	}
+	e.checkFile("good", data)
+	if len(order) != 3 || order[0] != "hash" || order[1] != "hash" || order[2] != "index" {
+		t.Fatal("order", order)
+	}
+	gets := 0
+	for _, v := range e.origin.Requests("good") {
+		if v.Method == http.MethodGet {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Fatal("downloaded again", gets)
+	}
+
+	//failed processor fails the task without retry and the file is removed
+	id = e.add(m, e.origin.Add("bad", dltest.File{Data: data}), "bad")
+	ev, _ = dltest.WaitEvent(sub, waitTimeout, func(ev downloadtaskmgr.TaskEvent) bool {
+		return ev.Task.Id == id && (ev.Type == downloadtaskmgr.Event_Failed || ev.Type == downloadtaskmgr.Event_Retried)
+	})
+	if ev.Type != downloadtaskmgr.Event_Failed || ev.Task.FailReason != downloadtaskmgr.FailReason_PostProcess || ev.Task.FailError != "index: index full" {
+		t.Fatal("fail", ev.Type, ev.Task.FailReason, ev.Task.FailError)
+	}
+	for _, name := range []string{"bad", "bad" + downloadtaskmgr.TempFileMark} {
+		if _, err := os.Stat(e.savePath(name)); !os.IsNotExist(err) {
+			t.Fatal("unprocessed file left", name)
+		}
+	}
+}
+
+func TestScheduledTask(t *testing.T) {
+	e := newTestEnv(t)
+	m, sub := e.start()
+
+	now := e.clock.Now()
+	data := dltest.RandomData(10 * 1000)
+	url := e.origin.Add("file", dltest.File{Data: data})
+	_, err := m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: url, SavePath: e.savePath("late"), Deadline: now.Unix()})
+	if err != downloadtaskmgr.ErrTaskExpired {
+		t.Fatal("expired task added", err)
+	}
+
+	id, err := m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: url, SavePath: e.savePath("file"), NotBefore: now.Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.wait(sub, id, downloadtaskmgr.Event_Scheduled)
+	list := m.ListTasks()
+	if len(list) != 1 || list[0].State != downloadtaskmgr.TaskState_Scheduled {
+		t.Fatal("state", list)
+	}
+	sub.Close()
+	m.Shutdown(context.Background())
+	if e.clock.Timers() != 0 {
+		t.Fatal("timer left after shutdown")
+	}
+
+	//scheduled task is saved and waits again after restart
+	m, sub = e.start()
+	list = m.ListTasks()
+	if len(list) != 1 || list[0].Task.Id != id || list[0].State != downloadtaskmgr.TaskState_Scheduled {
+		t.Fatal("restored state", list)
+	}
+	if !e.clock.WaitTimers(1, waitTimeout) {
+		t.Fatal("scheduled timer not set")
+	}
+	e.clock.Advance(time.Hour)
+	e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	e.checkFile("file", data)
+	if len(e.origin.Requests("file")) != 2 {
+		t.Fatal("requests", e.origin.Requests("file"))
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	e := newTestEnv(t)
+	m, sub := e.start()
+
+	now := e.clock.Now()
+	data := dltest.RandomData(200 * 1000)
+	url := e.origin.Add("stall", dltest.File{Data: data, StallAfter: 64 * 1024})
+	id, err := m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: url, SavePath: e.savePath("stall"), Deadline: now.Add(30 * time.Second).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//waiting task expires before it is queued
+	waitId, err := m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: url, SavePath: e.savePath("wait"), NotBefore: now.Add(time.Hour).Unix(), Deadline: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.wait(sub, id, downloadtaskmgr.Event_Started)
+
+	//running task is stopped and failed
+	e.clock.Advance(30 * time.Second)
+	ev := e.wait(sub, id, downloadtaskmgr.Event_Failed)
+	if ev.Task.FailReason != downloadtaskmgr.FailReason_Expired {
+		t.Fatal("fail reason", ev.Task.FailReason)
+	}
+	if _, err := os.Stat(e.savePath("stall") + downloadtaskmgr.TempFileMark); !os.IsNotExist(err) {
+		t.Fatal("temp file left")
+	}
+
+	e.clock.Advance(30 * time.Second)
+	ev = e.wait(sub, waitId, downloadtaskmgr.Event_Failed)
+	if ev.Task.FailReason != downloadtaskmgr.FailReason_Expired {
+		t.Fatal("fail reason", ev.Task.FailReason)
+	}
+	if len(m.ListTasks()) != 0 || e.clock.Timers() != 0 {
+		t.Fatal("expired task left", m.ListTasks(), e.clock.Timers())
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.MaxSpeedKBs = 1000
+	//clock starts at 12:26 UTC, 20% except the night
+	e.config.BandwidthSchedule = &downloadtaskmgr.BandwidthSchedule{
+		Windows:  []downloadtaskmgr.BandwidthWindow{{Start: time.Hour, End: 7 * time.Hour, Percent: 100}},
+		Percent:  20,
+		Location: time.UTC,
+	}
+	m, _ := e.start()
+	if o := m.GetOccupancy(); o.MaxSpeedKBs != 200 {
+		t.Fatal("day speed", o.MaxSpeedKBs)
+	}
+
+	//window across midnight
+	m.SetBandwidthSchedule(&downloadtaskmgr.BandwidthSchedule{
+		Windows:  []downloadtaskmgr.BandwidthWindow{{Start: 22 * time.Hour, End: 13 * time.Hour, Percent: 50}},
+		Location: time.UTC,
+	})
+	if o := m.GetOccupancy(); o.MaxSpeedKBs != 500 {
+		t.Fatal("window speed", o.MaxSpeedKBs)
+	}
+	m.SetMaxSpeed(2000)
+	if o := m.GetOccupancy(); o.MaxSpeedKBs != 1000 {
+		t.Fatal("max speed", o.MaxSpeedKBs)
+	}
+	//window ends at 13:00 and full speed after that
+	e.clock.Advance(34 * time.Minute)
+	deadline := time.Now().Add(waitTimeout)
+	for m.GetOccupancy().MaxSpeedKBs != 2000 {
+		if time.Now().After(deadline) {
+			t.Fatal("schedule not applied", m.GetOccupancy().MaxSpeedKBs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.SetBandwidthSchedule(nil)
+	if o := m.GetOccupancy(); o.MaxSpeedKBs != 2000 {
+		t.Fatal("no schedule", o.MaxSpeedKBs)
+	}
+}
+
+func TestSpaceReservation(t *testing.T) {
+	e := newTestEnv(t)
+	m, sub := e.start()
+
+	stallAt := int64(64 * 1024)
+	data := dltest.RandomData(200 * 1000)
+	id := e.add(m, e.origin.Add("stall", dltest.File{Data: data, StallAfter: stallAt}), "stall")
+	e.wait(sub, id, downloadtaskmgr.Event_Started)
+	if !e.clock.WaitTickers(2, waitTimeout) {
+		t.Fatal("speed monitor not started")
+	}
+	//reservations are read while progress is updated
+	for i := 0; i < 3; i++ {
+		e.clock.Advance(downloadtaskmgr.SpeedInterval)
+		m.SpaceReservations()
+		_, err := m.GetDiskSpace(e.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.wait(sub, id, downloadtaskmgr.Event_Progress)
+	}
+	list := m.SpaceReservations()
+	if len(list) != 1 || list[0].TaskId != id || list[0].Bytes != uint64(int64(len(data))-stallAt) {
+		t.Fatal("reservation", list)
+	}
+	e.origin.Release()
+	e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	if len(m.SpaceReservations()) != 0 {
+		t.Fatal("reservation left")
+	}
+}
+
+func TestRestoreDuplicates(t *testing.T) {
+	e := newTestEnv(t)
+	data := dltest.RandomData(10 * 1000)
+	info := downloadtaskmgr.DownloadInfo{TargetUrl: e.origin.Add("file", dltest.File{Data: data}), SavePath: e.savePath("file")}
+
+	//saved twice by older versions
+	m := downloadtaskmgr.NewManager(e.config)
+	err := m.Init(e.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SetTasksToLDB([]*downloadtaskmgr.DownloadTask{
+		{Id: 1, DownloadInfo: info, Status: downloadtaskmgr.Task_UnStart},
+		{Id: 2, DownloadInfo: info, Status: downloadtaskmgr.Task_Break},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Shutdown(context.Background())
+
+	m, sub := e.start()
+	list := m.ListTasks()
+	if len(list) != 1 || list[0].Task.Id != 1 {
+		t.Fatal("restored", list)
+	}
+	e.wait(sub, 1, downloadtaskmgr.Event_Succeeded)
+	e.checkFile("file", data)
+	if len(e.origin.Requests("file")) != 2 {
+		t.Fatal("requests", e.origin.Requests("file"))
+	}
+	tasks, err := m.LoopTasksInLDB()
+	if err != nil || len(tasks) != 0 {
+		t.Fatal("records left", tasks, err)
+	}
+}
+
+func TestCleanTempFiles(t *testing.T) {
+	e := newTestEnv(t)
+	dir := filepath.Join(e.dir, "files")
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(dir, "x.downloading.mp4")
+	owned := filepath.Join(dir, "y.downloading.mp4")
+	noExt := filepath.Join(dir, "z.downloading")
+	others := []string{filepath.Join(dir, "z.mp4"), filepath.Join(dir, "notes.downloading-v2.txt"), filepath.Join(dir, ".downloading")}
+	for _, v := range append([]string{stale, owned, noExt}, others...) {
+		err := ioutil.WriteFile(v, []byte("1"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exist := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	m := downloadtaskmgr.NewManager(e.config)
+	err = m.Init(e.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SetTaskToLDB(&downloadtaskmgr.DownloadTask{Id: 1, Status: downloadtaskmgr.Task_Paused, DownloadInfo: downloadtaskmgr.DownloadInfo{SavePath: filepath.Join(dir, "y.mp4")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Shutdown(context.Background())
+	//not cleaned by default, other managers may save files under the same root
+	if !exist(stale) || !exist(noExt) {
+		t.Fatal("temp file removed without CleanTempFiles")
+	}
+
+	e.config.CleanTempFiles = true
+	e.start()
+	if exist(stale) || exist(noExt) {
+		t.Fatal("stale temp file kept")
+	}
+	if !exist(owned) {
+		t.Fatal("temp file of task removed")
+	}
+	for _, v := range others {
+		if !exist(v) {
+			t.Fatal("not temp file removed", v)
+		}
+	}
+
+	//the default manager owns its root and cleans by default
+	err = ioutil.WriteFile(stale, []byte("1"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldbPath := downloadtaskmgr.LDBPath
+	downloadtaskmgr.LDBPath = filepath.Join(e.dir, "defaultdb")
+	defer func() {
+		downloadtaskmgr.LDBPath = ldbPath
+	}()
+	err = downloadtaskmgr.InitTaskMgr(e.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer downloadtaskmgr.Shutdown(context.Background())
+	if exist(stale) {
+		t.Fatal("stale temp file kept by default manager")
+	}
+}
+
+func TestNotEvictedBeforeStarted(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.NewRunningTaskCount = 1
+	m, sub := e.start()
+
+	//origin does not answer until released, the task has not started body
+	data := dltest.RandomData(10 * 1000)
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer hanging.Close()
+	defer close(release)
+	hangingId := e.add(m, hanging.URL+"/file", "hanging")
+	id := e.add(m, e.origin.Add("file", dltest.File{Data: data}), "file")
+
+	for i := 0; i < 4; i++ {
+		e.clock.Advance(downloadtaskmgr.ScanInterval)
+		time.Sleep(50 * time.Millisecond)
+	}
+	ev, broken := dltest.WaitEvent(sub, 200*time.Millisecond, dltest.IsEvent(hangingId, downloadtaskmgr.Event_Broken))
+	if broken {
+		t.Fatal("evicted before started", ev.Task.BreakReason)
+	}
+	release <- struct{}{}
+	release <- struct{}{}
+	e.waitSucceeded(sub, hangingId, id)
+}
+
+func TestResumeAfterCrash(t *testing.T) {
+	e := newTestEnv(t)
+	data := dltest.RandomData(200 * 1000)
+	info := downloadtaskmgr.DownloadInfo{TargetUrl: e.origin.Add("file", dltest.File{Data: data, ETag: `"file"`}), SavePath: e.savePath("file")}
+
+	//killed while downloading, record is what saved when body started
+	m := downloadtaskmgr.NewManager(e.config)
+	err := m.Init(e.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SetTaskToLDB(&downloadtaskmgr.DownloadTask{Id: 1, DownloadInfo: info, Status: downloadtaskmgr.Task_Downloading, ETag: `"file"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Shutdown(context.Background())
+	err = os.MkdirAll(filepath.Dir(e.savePath("file")), 0777)
+	if err == nil {
+		err = ioutil.WriteFile(e.savePath("file.downloading"), data[:65536], 0666)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, sub := e.start()
+	e.wait(sub, 1, downloadtaskmgr.Event_Succeeded)
+	e.checkFile("file", data)
+	requests := e.origin.Requests("file")
+	if last := requests[len(requests)-1]; last.Range != "bytes=65536-" {
+		t.Fatal("not resumed", last.Range)
+	}
+}
+
+// slowWorker delay the end of task worker after the task is queued again
+func slowWorker(m *downloadtaskmgr.Manager) {
+	m.SetPanicCatcher(func() {
+		time.Sleep(100 * time.Millisecond)
+	})
+}
+
+func TestHostLimitAcrossRetry(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.HostLimit = downloadtaskmgr.HostLimit{MaxConnections: 1}
+	e.config.RetryPolicy.InitialBackoff = 0
+	e.setup = slowWorker
+	m, sub := e.start()
+
+	busyData := dltest.RandomData(50 * 1000)
+	busyId := e.add(m, e.origin.Add("busy", dltest.File{Data: busyData, ErrorStatus: 503, ErrorTimes: 1, BytesPerSec: 100 * 1000}), "busy")
+	data := dltest.RandomData(10 * 1000)
+	id := e.add(m, e.origin.Add("other", dltest.File{Data: data}), "other")
+
+	e.wait(sub, busyId, downloadtaskmgr.Event_Retried)
+	e.waitSucceeded(sub, busyId, id)
+	e.checkFile("busy", busyData)
+	e.checkFile("other", data)
+	if active := e.origin.MaxActive(); active != 1 {
+		t.Fatal("connections of host", active)
+	}
+}
+
+func TestHostLimitAcrossBreak(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.NewRunningTaskCount = 1
+	e.config.HostLimit = downloadtaskmgr.HostLimit{MaxConnections: 1}
+	e.setup = slowWorker
+	m, sub := e.start()
+
+	stallAt := int64(64 * 1024)
+	//the rest takes a while after resumed, the other task must keep waiting meanwhile
+	slowData := dltest.RandomData(200 * 1000)
+	slowId := e.add(m, e.origin.Add("slow", dltest.File{Data: slowData, ETag: `"slow"`, StallAfter: stallAt, BytesPerSec: 200 * 1000}), "slow")
+	e.wait(sub, slowId, downloadtaskmgr.Event_Started)
+	//waits for the connection of the host
+	otherData := dltest.RandomData(10 * 1000)
+	otherId := e.add(m, e.origin.Add("other", dltest.File{Data: otherData}), "other")
+	//from another host, waits in global queue so the slow task is evicted
+	fastOrigin := dltest.NewOrigin()
+	defer fastOrigin.Close()
+	fastData := dltest.RandomData(20 * 1000)
+	fastId, err := m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: fastOrigin.Add("fast", dltest.File{Data: fastData}), SavePath: e.savePath("fast")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.clock.WaitTickers(2, waitTimeout) {
+		t.Fatal("speed monitor not started")
+	}
+	for i := 0; i < 10; i++ {
+		e.clock.Advance(downloadtaskmgr.SpeedInterval)
+		e.wait(sub, slowId, downloadtaskmgr.Event_Progress)
+	}
+	ev := e.wait(sub, slowId, downloadtaskmgr.Event_Broken)
+	if ev.Task.BreakReason != downloadtaskmgr.StopReason_Evicted {
+		t.Fatal("break", ev.Task.BreakReason)
+	}
+	e.wait(sub, slowId, downloadtaskmgr.Event_Queued)
+	e.origin.Release()
+	e.waitSucceeded(sub, slowId, otherId, fastId)
+	e.checkFile("slow", slowData)
+	e.checkFile("other", otherData)
+	e.checkFile("fast", fastData)
+	if active := e.origin.MaxActive(); active != 1 {
+		t.Fatal("connections of host", active)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	e := newTestEnv(t)
+	e.config.NewRunningTaskCount = 1
+	m, sub := e.start()
+
+	stallAt := int64(64 * 1024)
+	runningData := dltest.RandomData(200 * 1000)
+	runningUrl := e.origin.Add("running", dltest.File{Data: runningData, StallAfter: stallAt})
+	runningId := e.add(m, runningUrl, "running")
+	e.wait(sub, runningId, downloadtaskmgr.Event_Started)
+	_, err := m.AddTask(&downloadtaskmgr.DownloadInfo{TargetUrl: runningUrl, SavePath: e.savePath("running")})
+	var existErr *downloadtaskmgr.TaskExistError
+	if !errors.As(err, &existErr) || existErr.TaskId != runningId || !errors.Is(err, downloadtaskmgr.ErrTaskExist) {
+		t.Fatal("duplicated", err)
+	}
+
+	//attached callbacks are called once when task is done
+	done := make(chan bool, 10)
+	onDone := func(task *downloadtaskmgr.DownloadTask, success bool) {
+		if task.Id != runningId {
+			t.Error("callback of task", task.Id)
+		}
+		done <- success
+	}
+	for i := 0; i < 2; i++ {
+		id, err := m.AddOrAttachTask(&downloadtaskmgr.DownloadInfo{TargetUrl: runningUrl, SavePath: e.savePath("running")}, onDone)
+		if err != nil || id != runningId {
+			t.Fatal("attach", id, err)
+		}
+	}
+
+	//queued task is added again at once after cancelled
+	data := dltest.RandomData(10 * 1000)
+	url := e.origin.Add("queued", dltest.File{Data: data})
+	queuedId := e.add(m, url, "queued")
+	e.wait(sub, queuedId, downloadtaskmgr.Event_Queued)
+	err = m.CancelTask(queuedId)
+	if err != nil {
+		t.Fatal("cancel", err)
+	}
+	id := e.add(m, url, "queued")
+	if id == queuedId {
+		t.Fatal("id reused")
+	}
+
+	e.origin.Release()
+	e.waitSucceeded(sub, runningId, id)
+	for i := 0; i < 2; i++ {
+		select {
+		case success := <-done:
+			if !success {
+				t.Fatal("callback not success")
+			}
+		case <-time.After(waitTimeout):
+			t.Fatal("callback not called")
+		}
+	}
+	e.checkFile("running", runningData)
+	e.checkFile("queued", data)
+
+	//finished file is added as a new task
+	newId, err := m.AddOrAttachTask(&downloadtaskmgr.DownloadInfo{TargetUrl: url, SavePath: e.savePath("queued")}, nil)
+	if err != nil || newId == id {
+		t.Fatal("add finished file", newId, err)
+	}
+	e.wait(sub, newId, downloadtaskmgr.Event_Succeeded)
+	select {
+	case <-done:
+		t.Fatal("callback called again")
+	default:
+	}
+}
+
+func TestCancelPauseResume(t *testing.T) {
+	e := newTestEnv(t)
+	m, sub := e.start()
+
+	//cancelled while waiting for retry
+	url := e.origin.Add("file", dltest.File{Data: dltest.RandomData(10 * 1000), ErrorStatus: 503})
+	id := e.add(m, url, "file")
+	e.wait(sub, id, downloadtaskmgr.Event_Retried)
+	if !e.clock.WaitTimers(1, waitTimeout) {
+		t.Fatal("retry timer not set")
+	}
+	err := m.CancelTask(id)
+	if err != nil {
+		t.Fatal("cancel", err)
+	}
+	e.wait(sub, id, downloadtaskmgr.Event_Cancelled)
+	if e.clock.Timers() != 0 || m.GetTask(id) != nil {
+		t.Fatal("cancelled task left", e.clock.Timers())
+	}
+	if m.CancelTask(id) != downloadtaskmgr.ErrTaskNotExist {
+		t.Fatal("cancelled twice")
+	}
+
+	//new task of the same file is not affected by the cancelled one
+	stallAt := int64(64 * 1024)
+	data := dltest.RandomData(200 * 1000)
+	e.origin.Add("file", dltest.File{Data: data, ETag: `"file"`, StallAfter: stallAt})
+	id = e.add(m, url, "file")
+	e.wait(sub, id, downloadtaskmgr.Event_Started)
+	e.clock.Advance(e.config.RetryPolicy.MaxBackoff)
+
+	//paused task keeps its file and resumes from where it stopped
+	err = m.PauseTask(id)
+	if err != nil {
+		t.Fatal("pause", err)
+	}
+	e.wait(sub, id, downloadtaskmgr.Event_Paused)
+	tasks, err := m.LoopTasksInLDB()
+	if err != nil || len(tasks) != 1 || tasks[0].Status != downloadtaskmgr.Task_Paused {
+		t.Fatal("paused record", tasks, err)
+	}
+	if _, err := os.Stat(e.savePath("file") + downloadtaskmgr.TempFileMark); err != nil {
+		t.Fatal("partial file", err)
+	}
+	e.origin.Release()
+	err = m.ResumeTask(id)
+	if err != nil {
+		t.Fatal("resume", err)
+	}
+	e.wait(sub, id, downloadtaskmgr.Event_Succeeded)
+	e.checkFile("file", data)
+	//released body may go on a little before the paused run stops
+	requests := e.origin.Requests("file")
+	if last := requests[len(requests)-1]; !strings.HasPrefix(last.Range, "bytes=") || last.Range == "bytes=0-" {
+		t.Fatal("not resumed", last.Range)
+	}
+}
@@ -0,0 +1,195 @@
+// Package metrics export prometheus metrics of a download manager
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daqnext/meson-common/common/downloadtaskmgr"
+	"github.com/daqnext/meson-common/common/ginrouter"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "meson"
+const subsystem = "download"
+
+// EventBufferSize buffer of the event subscription, events dropped are counted in meson_download_events_dropped_total
+const EventBufferSize = 4096
+
+type taskProgress struct {
+	downloaded int64
+	startTime  time.Time
+}
+
+// Metrics keep the counters of a manager, gauges are read from the manager when scraped
+type Metrics struct {
+	m   *downloadtaskmgr.Manager
+	sub *downloadtaskmgr.Subscription
+
+	events          *prometheus.CounterVec
+	downloadedBytes *prometheus.CounterVec
+	duration        *prometheus.HistogramVec
+	throughput      *prometheus.HistogramVec
+
+	queuedDesc        *prometheus.Desc
+	runningDesc       *prometheus.Desc
+	idleDesc          *prometheus.Desc
+	eventsDroppedDesc *prometheus.Desc
+
+	lock  sync.Mutex
+	tasks map[uint64]*taskProgress
+
+	registry *prometheus.Registry
+}
+
+// New subscribe events of m, Close it when m is shut down
+func New(m *downloadtaskmgr.Manager) *Metrics {
+	x := &Metrics{
+		m:     m,
+		tasks: map[uint64]*taskProgress{},
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "task_events_total",
+			Help:      "Task lifecycle events like queued, started, succeeded, failed, broken and retried.",
+		}, []string{"event", "download_type"}),
+		downloadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "downloaded_bytes_total",
+			Help:      "Bytes downloaded by all tasks.",
+		}, []string{"download_type"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "task_duration_seconds",
+			Help:      "Time from first start to success of tasks.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+		}, []string{"download_type"}),
+		throughput: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "task_throughput_kbs",
+			Help:      "Average speed of succeeded tasks in KB/s.",
+			Buckets:   prometheus.ExponentialBuckets(10, 2, 14),
+		}, []string{"download_type"}),
+		queuedDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "queued_tasks"),
+			"Tasks waiting in the global queue.", nil, nil),
+		runningDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "running_tasks"),
+			"Running tasks of channel, channel \"new\" is tasks from the global queue.", []string{"channel"}, nil),
+		idleDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "idle_queue_length"),
+			"Tasks waiting in the idle queue of channel.", []string{"channel"}, nil),
+		eventsDroppedDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, "events_dropped_total"),
+			"Events not counted because metrics can not keep up.", nil, nil),
+	}
+	x.registry = prometheus.NewRegistry()
+	x.registry.MustRegister(x)
+
+	x.sub = m.Subscribe(EventBufferSize)
+	go x.loop()
+	return x
+}
+
+// Close stop counting events
+func (x *Metrics) Close() {
+	x.sub.Close()
+}
+
+func (x *Metrics) loop() {
+	for event := range x.sub.C {
+		x.handleEvent(&event)
+	}
+}
+
+func downloadType(task *downloadtaskmgr.DownloadTask) string {
+	if task.DownloadType == "" {
+		return "unknown"
+	}
+	return task.DownloadType
+}
+
+func (x *Metrics) handleEvent(event *downloadtaskmgr.TaskEvent) {
+	task := &event.Task
+	dlType := downloadType(task)
+	if event.Type != downloadtaskmgr.Event_Progress {
+		x.events.WithLabelValues(string(event.Type), dlType).Inc()
+	}
+
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	progress, exist := x.tasks[task.Id]
+	if !exist {
+		progress = &taskProgress{downloaded: task.DownloadedSize}
+		x.tasks[task.Id] = progress
+	}
+
+	switch event.Type {
+	case downloadtaskmgr.Event_Started:
+		if progress.startTime.IsZero() {
+			progress.startTime = event.Time
+		}
+		//download from beginning or resume from the partial file
+		progress.downloaded = task.DownloadedSize
+	case downloadtaskmgr.Event_Progress, downloadtaskmgr.Event_Broken, downloadtaskmgr.Event_Succeeded, downloadtaskmgr.Event_Failed:
+		if task.DownloadedSize > progress.downloaded {
+			x.downloadedBytes.WithLabelValues(dlType).Add(float64(task.DownloadedSize - progress.downloaded))
+		}
+		progress.downloaded = task.DownloadedSize
+	}
+
+	switch event.Type {
+	case downloadtaskmgr.Event_Succeeded:
+		if !progress.startTime.IsZero() {
+			used := event.Time.Sub(progress.startTime).Seconds()
+			x.duration.WithLabelValues(dlType).Observe(used)
+			if used > 0 {
+				x.throughput.WithLabelValues(dlType).Observe(float64(task.FileSize) / 1000 / used)
+			}
+		}
+		delete(x.tasks, task.Id)
+	case downloadtaskmgr.Event_Failed, downloadtaskmgr.Event_Cancelled:
+		delete(x.tasks, task.Id)
+	}
+}
+
+func (x *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	x.events.Describe(ch)
+	x.downloadedBytes.Describe(ch)
+	x.duration.Describe(ch)
+	x.throughput.Describe(ch)
+	ch <- x.queuedDesc
+	ch <- x.runningDesc
+	ch <- x.idleDesc
+	ch <- x.eventsDroppedDesc
+}
+
+func (x *Metrics) Collect(ch chan<- prometheus.Metric) {
+	x.events.Collect(ch)
+	x.downloadedBytes.Collect(ch)
+	x.duration.Collect(ch)
+	x.throughput.Collect(ch)
+
+	o := x.m.GetOccupancy()
+	ch <- prometheus.MustNewConstMetric(x.queuedDesc, prometheus.GaugeValue, float64(o.Queued))
+	ch <- prometheus.MustNewConstMetric(x.runningDesc, prometheus.GaugeValue, float64(o.NewTaskRunning), "new")
+	for _, v := range o.Channels {
+		channel := strconv.Itoa(v.Index)
+		ch <- prometheus.MustNewConstMetric(x.runningDesc, prometheus.GaugeValue, float64(v.Running), channel)
+		ch <- prometheus.MustNewConstMetric(x.idleDesc, prometheus.GaugeValue, float64(v.Idle), channel)
+	}
+	ch <- prometheus.MustNewConstMetric(x.eventsDroppedDesc, prometheus.CounterValue, float64(x.sub.Dropped()))
+}
+
+// Handler serve metrics of this manager only
+func (x *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(x.registry, promhttp.HandlerOpts{})
+}
+
+// Attach serve metrics at relativePath of router, like "/metrics"
+func (x *Metrics) Attach(router *ginrouter.GinAutoRouter, relativePath string) {
+	router.GinInstance.GET(relativePath, gin.WrapH(x.Handler()))
+}
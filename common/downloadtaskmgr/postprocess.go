@@ -0,0 +1,127 @@
+package downloadtaskmgr
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+// FailReason_PostProcess a post processor returned error, FailError tells which one and why
+const FailReason_PostProcess FailReason = "post_process"
+
+// PostProcessor runs on the downloaded file before the task is reported successful,
+// like hashing, updating file index, unpacking or generating HLS segments
+type PostProcessor interface {
+	Name() string
+	//task is a copy, filePath is the downloaded temp file which is moved to task.SavePath after all processors succeed,
+	//report percent 0-100 of this processor, stop when ctx is done
+	Process(ctx context.Context, task *DownloadTask, filePath string, report func(percent float64)) error
+}
+
+type funcPostProcessor struct {
+	name string
+	fn   func(ctx context.Context, task *DownloadTask, filePath string, report func(percent float64)) error
+}
+
+func (p *funcPostProcessor) Name() string {
+	return p.name
+}
+
+func (p *funcPostProcessor) Process(ctx context.Context, task *DownloadTask, filePath string, report func(percent float64)) error {
+	return p.fn(ctx, task, filePath, report)
+}
+
+// NewPostProcessor make a PostProcessor of function
+func NewPostProcessor(name string, fn func(ctx context.Context, task *DownloadTask, filePath string, report func(percent float64)) error) PostProcessor {
+	return &funcPostProcessor{name: name, fn: fn}
+}
+
+// SetPostProcessors replace the chain at runtime, tasks already processing keep the old chain
+func (m *Manager) SetPostProcessors(processors []PostProcessor) {
+	m.postLock.Lock()
+	m.postProcessors = append([]PostProcessor{}, processors...)
+	m.postLock.Unlock()
+}
+
+// completeDownload run post processors on the verified temp file and move it to SavePath only if they all succeed.
+// If the task is stopped meanwhile the temp file is kept, the processors run again next time without downloading.
+func (m *Manager) completeDownload(ctx context.Context, task *DownloadTask) ExecResult {
+	m.taskLock.Lock()
+	task.FileComplete = true
+	m.taskLock.Unlock()
+	result := m.postProcess(ctx, task)
+	if result != Success {
+		return result
+	}
+	err := commitDownloadFile(task)
+	if err != nil {
+		return m.failTaskByError(task, err)
+	}
+	return Success
+}
+
+// fileCompleteLeft return true if the file was downloaded by the last run and it is still there
+func (m *Manager) fileCompleteLeft(task *DownloadTask) bool {
+	m.taskLock.Lock()
+	defer m.taskLock.Unlock()
+	if !task.FileComplete {
+		return false
+	}
+	fileInfo, err := os.Stat(tempFilePath(task.SavePath))
+	if err == nil && fileInfo.Size() > 0 && (task.FileSize <= 0 || fileInfo.Size() == task.FileSize) {
+		return true
+	}
+	task.FileComplete = false
+	return false
+}
+
+// postProcess run the chain in order on the temp file, the temp file is removed by TaskFail if a processor fails
+func (m *Manager) postProcess(ctx context.Context, task *DownloadTask) ExecResult {
+	m.postLock.Lock()
+	processors := m.postProcessors
+	m.postLock.Unlock()
+	if len(processors) == 0 {
+		return Success
+	}
+	//file is downloaded, origin connection is not needed any more
+	m.releaseHost(task)
+
+	for _, p := range processors {
+		name := p.Name()
+		m.setPostProcess(task, name, 0)
+		err := p.Process(ctx, m.snapshotTask(task), tempFilePath(task.SavePath), func(percent float64) {
+			m.setPostProcess(task, name, percent)
+		})
+		if err == nil && ctx.Err() == nil {
+			continue
+		}
+
+		m.clearPostProcess(task)
+		if ctx.Err() != nil {
+			return Break
+		}
+		logger.Error("post process error", "err", err, "id", task.Id, "processor", name)
+		m.setFail(task, FailReason_PostProcess, 0, fmt.Errorf("%s: %w", name, err))
+		return Fail
+	}
+	m.clearPostProcess(task)
+	return Success
+}
+
+// setPostProcess record progress of current processor and publish Event_Processing
+func (m *Manager) setPostProcess(task *DownloadTask, name string, percent float64) {
+	m.taskLock.Lock()
+	task.PostProcessor = name
+	task.PostProcessPercent = percent
+	m.publishLocked(Event_Processing, task, 0)
+	m.taskLock.Unlock()
+}
+
+func (m *Manager) clearPostProcess(task *DownloadTask) {
+	m.taskLock.Lock()
+	task.PostProcessor = ""
+	task.PostProcessPercent = 0
+	m.taskLock.Unlock()
+}
@@ -0,0 +1,148 @@
+package downloadtaskmgr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// minimum burst, one read of copy buffer
+const minBurstBytes = 32 * 1024
+
+// RateLimiter token bucket limit in KB/s, 0 means unlimited
+type RateLimiter struct {
+	lock     sync.Mutex
+	limitKBs int64
+	tokens   float64 //bytes, negative means borrowed
+	lastTime time.Time
+}
+
+func NewRateLimiter(limitKBs int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetLimit(limitKBs)
+	return l
+}
+
+func (l *RateLimiter) SetLimit(limitKBs int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if limitKBs < 0 {
+		limitKBs = 0
+	}
+	l.limitKBs = limitKBs
+	l.tokens = 0
+	l.lastTime = time.Now()
+}
+
+func (l *RateLimiter) Limit() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limitKBs
+}
+
+// reserve take n bytes from bucket and return how long to wait before using them
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.limitKBs <= 0 {
+		return 0
+	}
+
+	bytesPerSec := float64(l.limitKBs * 1000)
+	burst := bytesPerSec
+	if burst < minBurstBytes {
+		burst = minBurstBytes
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.lastTime).Seconds() * bytesPerSec
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.lastTime = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / bytesPerSec * float64(time.Second))
+}
+
+// waitLimiters block until n bytes are allowed by all limiters or ctx is done, nil limiter is ignored
+func waitLimiters(ctx context.Context, n int, limiters ...*RateLimiter) error {
+	wait := time.Duration(0)
+	for _, v := range limiters {
+		if v == nil {
+			continue
+		}
+		w := v.reserve(n)
+		if w > wait {
+			wait = w
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// taskLimiters limiters of manager, running channel, task and origin host
+func (m *Manager) taskLimiters(task *DownloadTask) []*RateLimiter {
+	channelLimiter := m.newTaskLimiter
+	if task.runningChannel != nil {
+		channelLimiter = task.runningChannel.limiter
+	}
+
+	m.taskLock.Lock()
+	if task.limiter == nil {
+		task.limiter = NewRateLimiter(task.MaxSpeedKBs)
+	}
+	taskLimiter := task.limiter
+	m.taskLock.Unlock()
+
+	return []*RateLimiter{m.globalLimiter, channelLimiter, taskLimiter, m.hostLimiter(task)}
+}
+
+// SetMaxSpeed change speed cap of all tasks at runtime, 0 means unlimited, BandwidthSchedule applies on it
+func (m *Manager) SetMaxSpeed(kbs int64) {
+	m.speedLock.Lock()
+	m.maxSpeedKBs = kbs
+	m.speedLock.Unlock()
+	m.applyBandwidthSchedule()
+}
+
+func (m *Manager) SetNewTaskMaxSpeed(kbs int64) {
+	m.newTaskLimiter.SetLimit(kbs)
+}
+
+func (m *Manager) SetChannelMaxSpeed(channelIndex int, kbs int64) error {
+	if channelIndex < 0 || channelIndex >= len(m.channelArray) {
+		return errors.New("channel index out of range")
+	}
+	m.channelArray[channelIndex].limiter.SetLimit(kbs)
+	return nil
+}
+
+func (m *Manager) SetTaskMaxSpeed(id uint64, kbs int64) error {
+	task := m.loadTask(id)
+	if task == nil {
+		return ErrTaskNotExist
+	}
+
+	m.taskLock.Lock()
+	task.MaxSpeedKBs = kbs
+	if task.limiter != nil {
+		task.limiter.SetLimit(kbs)
+	}
+	m.taskLock.Unlock()
+
+	m.SetTaskToLDB(task)
+	return nil
+}
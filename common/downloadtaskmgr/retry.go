@@ -0,0 +1,176 @@
+package downloadtaskmgr
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy decide whether and when a failed task is tried again
+type RetryPolicy struct {
+	MaxAttempts     int           //task fail after tried so many times, include the first try, 0 means 3 and 1 means no retry
+	InitialBackoff  time.Duration //wait before the first retry, 0 means retry at once
+	MaxBackoff      time.Duration //0 means no upper bound
+	Multiplier      float64       //backoff grows by this factor every retry
+	Jitter          float64       //0-1, part of backoff which is randomized
+	RetryableStatus []int         //http status codes worth retrying, other status fail the task at once, nil means the default list
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     3,
+		InitialBackoff:  5 * time.Second,
+		MaxBackoff:      5 * time.Minute,
+		Multiplier:      2,
+		Jitter:          0.2,
+		RetryableStatus: []int{408, 425, 429, 500, 502, 503, 504},
+	}
+}
+
+// transient reasons are retried, see RetryPolicy.retryable
+const (
+	FailReason_BadUrl          FailReason = "bad_url"
+	FailReason_HttpStatus      FailReason = "http_status" //status code is in FailStatusCode
+	FailReason_Timeout         FailReason = "timeout"
+	FailReason_ConnectionReset FailReason = "connection_reset"
+	FailReason_DNS             FailReason = "dns"
+	FailReason_Network         FailReason = "network"
+	FailReason_DiskFull        FailReason = "disk_full"
+	FailReason_FileError       FailReason = "file_error"
+	FailReason_ContentRange    FailReason = "content_range"
+	FailReason_Incomplete      FailReason = "incomplete"
+)
+
+// statusError unexpected http status of origin
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return "unexpected http status " + strconv.Itoa(e.code)
+}
+
+func isStatusError(err error) bool {
+	var se *statusError
+	return errors.As(err, &se)
+}
+
+func (p RetryPolicy) retryable(task *DownloadTask) bool {
+	switch task.FailReason {
+	case FailReason_BadUrl, FailReason_SizeMismatch, FailReason_HashMismatch, FailReason_PostProcess:
+		return false
+	case FailReason_HttpStatus:
+		for _, v := range p.RetryableStatus {
+			if v == task.FailStatusCode {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// shouldRetry tryTimes is the count of retries already done
+func (p RetryPolicy) shouldRetry(task *DownloadTask) bool {
+	return task.TryTimes+1 < p.MaxAttempts && p.retryable(task)
+}
+
+// backoff wait time before the retry number tryTimes, start from 1
+func (p RetryPolicy) backoff(tryTimes int) time.Duration {
+	if p.InitialBackoff <= 0 {
+		return 0
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < tryTimes; i++ {
+		delay *= multiplier
+		if p.MaxBackoff > 0 && delay >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 {
+		delay -= delay * jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// classifyError map a download error to the fail reason, and http status code if any
+func classifyError(err error) (FailReason, int) {
+	var se *statusError
+	if errors.As(err, &se) {
+		return FailReason_HttpStatus, se.code
+	}
+	if err == errSegmentRange {
+		return FailReason_ContentRange, 0
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return FailReason_DiskFull, 0
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return FailReason_DNS, 0
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return FailReason_Timeout, 0
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return FailReason_ConnectionReset, 0
+	}
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return FailReason_FileError, 0
+	}
+	return FailReason_Network, 0
+}
+
+// failTask record why the task failed
+func (m *Manager) failTask(task *DownloadTask, reason FailReason, err error) ExecResult {
+	m.setFail(task, reason, 0, err)
+	return Fail
+}
+
+func (m *Manager) failTaskByError(task *DownloadTask, err error) ExecResult {
+	reason, statusCode := classifyError(err)
+	m.setFail(task, reason, statusCode, err)
+	return Fail
+}
+
+// setFail record why the task failed, empty reason clears it
+func (m *Manager) setFail(task *DownloadTask, reason FailReason, statusCode int, err error) {
+	m.taskLock.Lock()
+	defer m.taskLock.Unlock()
+	task.FailReason = reason
+	task.FailStatusCode = statusCode
+	task.FailError = ""
+	if err != nil {
+		task.FailError = err.Error()
+	}
+}
+
+func checkTargetUrl(targetUrl string) error {
+	u, err := url.Parse(targetUrl)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("unsupported url " + targetUrl)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package downloadtaskmgr
+
+import (
+	"errors"
+	"time"
+
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+// FailReason_Expired task is not finished before its Deadline
+const FailReason_Expired FailReason = "expired"
+
+var ErrTaskExpired = errors.New("task deadline passed")
+
+// BandwidthWindow speed of the manager in a period of every day
+type BandwidthWindow struct {
+	Start   time.Duration //since midnight
+	End     time.Duration //window crosses midnight if End <= Start
+	Percent int           //percent of MaxSpeedKBs
+}
+
+// BandwidthSchedule change the speed cap of all tasks by time of day, like full speed 01:00-07:00 and 20% otherwise.
+// Percent applies to MaxSpeedKBs, so the schedule takes no effect when MaxSpeedKBs is 0.
+type BandwidthSchedule struct {
+	Windows  []BandwidthWindow //first matched window is used
+	Percent  int               //percent outside windows, 0 means 100
+	Location *time.Location    //nil means time.Local
+}
+
+func (w BandwidthWindow) contains(sinceMidnight time.Duration) bool {
+	if w.Start < w.End {
+		return sinceMidnight >= w.Start && sinceMidnight < w.End
+	}
+	return sinceMidnight >= w.Start || sinceMidnight < w.End
+}
+
+// percentAt percent of MaxSpeedKBs at time now
+func (s BandwidthSchedule) percentAt(now time.Time) int {
+	location := s.Location
+	if location == nil {
+		location = time.Local
+	}
+	now = now.In(location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	sinceMidnight := now.Sub(midnight)
+
+	percent := s.Percent
+	for _, v := range s.Windows {
+		if v.contains(sinceMidnight) {
+			percent = v.Percent
+			break
+		}
+	}
+	if percent <= 0 {
+		percent = 100
+	}
+	return percent
+}
+
+// SetBandwidthSchedule replace the schedule at runtime, nil means always MaxSpeedKBs
+func (m *Manager) SetBandwidthSchedule(schedule *BandwidthSchedule) {
+	m.speedLock.Lock()
+	m.bandwidthSchedule = schedule
+	m.speedLock.Unlock()
+	m.applyBandwidthSchedule()
+}
+
+// applyBandwidthSchedule update the global limiter by MaxSpeedKBs and schedule, it is called by the scan loop
+func (m *Manager) applyBandwidthSchedule() {
+	m.speedLock.Lock()
+	defer m.speedLock.Unlock()
+	limit := m.maxSpeedKBs
+	if m.bandwidthSchedule != nil && limit > 0 {
+		limit = limit * int64(m.bandwidthSchedule.percentAt(m.clock.Now())) / 100
+		if limit <= 0 {
+			limit = 1
+		}
+	}
+	//SetLimit empties the bucket
+	if limit != m.globalLimiter.Limit() {
+		logger.Debug("download speed cap changed", "maxSpeedKBs", limit)
+		m.globalLimiter.SetLimit(limit)
+	}
+}
+
+func (t *DownloadTask) expired(now time.Time) bool {
+	return t.Deadline > 0 && now.Unix() >= t.Deadline
+}
+
+// notBeforeDelay how long the task waits before it can be queued
+func (m *Manager) notBeforeDelay(task *DownloadTask) time.Duration {
+	if task.NotBefore <= 0 {
+		return 0
+	}
+	return time.Unix(task.NotBefore, 0).Sub(m.clock.Now())
+}
+
+// expireTaskLocked take a not running task out of queues, the task is dropped when taken out from channel idle queue.
+// expireTask must be called after taskLock is released.
+func (m *Manager) expireTaskLocked(task *DownloadTask) {
+	task.Status = Task_Expired
+	m.removeFromScheduler(task)
+	m.stopRetryTimerLocked(task.Id)
+	delete(m.queuedTasks, task.Id)
+	task.FailReason = FailReason_Expired
+	task.FailStatusCode = 0
+	task.FailError = ErrTaskExpired.Error()
+}
+
+func (m *Manager) expireTask(task *DownloadTask) {
+	logger.Debug("task expired", "id", task.Id, "deadline", task.Deadline)
+	m.releaseHost(task)
+	m.TaskFail(task)
+}
+
+// expireTasks fail tasks past their Deadline, running tasks are broken and failed by StartTask
+func (m *Manager) expireTasks() {
+	now := m.clock.Now()
+	expired := []*DownloadTask{}
+	m.taskMap.Range(func(key, value interface{}) bool {
+		task := value.(*DownloadTask)
+		m.taskLock.Lock()
+		defer m.taskLock.Unlock()
+		if !task.expired(now) {
+			return true
+		}
+		switch task.Status {
+		case Task_Downloading:
+			m.breakRunningTaskLocked(task, StopReason_Expired)
+		case Task_Cancelled, Task_Expired, Task_Break:
+			//cleaned by whom stopped it, broken task is stopping
+		default:
+			m.expireTaskLocked(task)
+			expired = append(expired, task)
+		}
+		return true
+	})
+	for _, v := range expired {
+		m.expireTask(v)
+	}
+}
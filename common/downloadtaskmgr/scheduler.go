@@ -0,0 +1,221 @@
+package downloadtaskmgr
+
+import (
+	"errors"
+	"sync"
+)
+
+type TaskPriority int
+
+// zero value is normal, so old tasks in leveldb keep normal priority
+const (
+	PriorityLow    TaskPriority = -1
+	PriorityNormal TaskPriority = 0
+	PriorityHigh   TaskPriority = 1
+	//always run before other priorities, like live stream pre-cache
+	PriorityUrgent TaskPriority = 2
+)
+
+// DefaultPriorityWeights weights of weighted round-robin, PriorityUrgent is not included because it is strict
+var DefaultPriorityWeights = map[TaskPriority]int{
+	PriorityHigh:   4,
+	PriorityNormal: 2,
+	PriorityLow:    1,
+}
+
+var ErrQueueFull = errors.New("download task queue is full")
+
+// bindNameQueue round-robin between BindNames of the same priority
+type bindNameQueue struct {
+	bindNames []string
+	tasks     map[string][]*DownloadTask
+	next      int
+	count     int
+	//current weight of smooth weighted round-robin
+	current int
+}
+
+func (q *bindNameQueue) push(task *DownloadTask) {
+	if _, exist := q.tasks[task.BindName]; !exist {
+		q.bindNames = append(q.bindNames, task.BindName)
+	}
+	q.tasks[task.BindName] = append(q.tasks[task.BindName], task)
+	q.count++
+}
+
+func (q *bindNameQueue) pop() *DownloadTask {
+	if q.count == 0 {
+		return nil
+	}
+	if q.next >= len(q.bindNames) {
+		q.next = 0
+	}
+	bindName := q.bindNames[q.next]
+	list := q.tasks[bindName]
+	task := list[0]
+	list[0] = nil
+	q.count--
+	if len(list) == 1 {
+		q.removeBindName(q.next)
+	} else {
+		q.tasks[bindName] = list[1:]
+		q.next++
+	}
+	return task
+}
+
+func (q *bindNameQueue) remove(id uint64) *DownloadTask {
+	for i, bindName := range q.bindNames {
+		list := q.tasks[bindName]
+		for j, task := range list {
+			if task.Id != id {
+				continue
+			}
+			q.count--
+			if len(list) == 1 {
+				q.removeBindName(i)
+				if i < q.next {
+					q.next--
+				}
+			} else {
+				q.tasks[bindName] = append(list[:j:j], list[j+1:]...)
+			}
+			return task
+		}
+	}
+	return nil
+}
+
+func (q *bindNameQueue) removeBindName(index int) {
+	delete(q.tasks, q.bindNames[index])
+	q.bindNames = append(q.bindNames[:index], q.bindNames[index+1:]...)
+}
+
+// taskScheduler replace the FIFO global queue, tasks are picked by priority and then by BindName
+type taskScheduler struct {
+	lock    sync.Mutex
+	levels  map[TaskPriority]*bindNameQueue
+	weights map[TaskPriority]int
+	count   int
+	notify  chan struct{}
+}
+
+func newTaskScheduler(weights map[TaskPriority]int) *taskScheduler {
+	if weights == nil {
+		weights = DefaultPriorityWeights
+	}
+	s := &taskScheduler{
+		levels:  map[TaskPriority]*bindNameQueue{},
+		weights: weights,
+		notify:  make(chan struct{}, 1),
+	}
+	return s
+}
+
+// push never block, new tasks are limited by GlobalQueueSize by checkNewTasks, broken and retried tasks are always accepted
+func (s *taskScheduler) push(task *DownloadTask) {
+	s.lock.Lock()
+	priority := normalizePriority(task.Priority)
+	level, exist := s.levels[priority]
+	if !exist {
+		level = &bindNameQueue{tasks: map[string][]*DownloadTask{}}
+		s.levels[priority] = level
+	}
+	level.push(task)
+	s.count++
+	s.lock.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *taskScheduler) tryPop() *DownloadTask {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.count == 0 {
+		return nil
+	}
+
+	level := s.levels[PriorityUrgent]
+	if level == nil || level.count == 0 {
+		level = s.pickLevel()
+	}
+	if level == nil {
+		return nil
+	}
+	task := level.pop()
+	if task != nil {
+		s.count--
+	}
+	return task
+}
+
+// pickLevel smooth weighted round-robin like nginx upstream
+func (s *taskScheduler) pickLevel() *bindNameQueue {
+	var best *bindNameQueue
+	total := 0
+	for priority, level := range s.levels {
+		if priority == PriorityUrgent || level.count == 0 {
+			continue
+		}
+		weight := s.weights[priority]
+		if weight <= 0 {
+			weight = 1
+		}
+		level.current += weight
+		total += weight
+		if best == nil || level.current > best.current {
+			best = level
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+// pop block until there is a task, return nil if stop is closed
+func (s *taskScheduler) pop(stop <-chan struct{}) *DownloadTask {
+	for {
+		task := s.tryPop()
+		if task != nil {
+			return task
+		}
+		select {
+		case <-s.notify:
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+func (s *taskScheduler) remove(id uint64) *DownloadTask {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, level := range s.levels {
+		task := level.remove(id)
+		if task != nil {
+			s.count--
+			return task
+		}
+	}
+	return nil
+}
+
+func (s *taskScheduler) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.count
+}
+
+func normalizePriority(priority TaskPriority) TaskPriority {
+	if priority < PriorityLow {
+		return PriorityLow
+	}
+	if priority > PriorityUrgent {
+		return PriorityUrgent
+	}
+	return priority
+}
@@ -0,0 +1,454 @@
+package downloadtaskmgr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+// file bigger than this will be downloaded with several connections if origin support range
+const SegmentDownloadThreshold int64 = 64 * 1024 * 1024
+
+// concurrent connections of a segmented task
+const SegmentCount = 4
+
+const minSegmentSize = 4 * 1024 * 1024
+const segmentMaxBreakTimes = 3
+const segmentMaxFailTimes = 2
+
+// segment slower than 1/segmentSlowRatio of the average segment speed will be broken and re-queued
+const segmentSlowRatio = 4
+
+var errSegmentBreak = errors.New("segment break")
+var errSegmentRange = errors.New("segment range not satisfied")
+
+type DownloadSegment struct {
+	Start      int64 //first byte
+	End        int64 //last byte, inclusive
+	Downloaded int64
+	BreakTimes int
+	FailTimes  int
+}
+
+func (s *DownloadSegment) remain() int64 {
+	return s.End - s.Start + 1 - s.Downloaded
+}
+
+type segmentRun struct {
+	segment        *DownloadSegment
+	body           io.ReadCloser
+	startTime      int64
+	fromDownloaded int64
+	broken         bool
+}
+
+type segmentDownloader struct {
+	ctx       context.Context
+	clock     Clock
+	task      *DownloadTask
+	url       string
+	client    *http.Client
+	validator string
+	file      *os.File
+	limiters  []*RateLimiter
+
+	lock     sync.Mutex
+	segments []*DownloadSegment //copy of task.Segments, task is updated by monitor
+	pending  []*DownloadSegment
+	running  map[*segmentRun]bool
+	stop     bool
+	failed   bool
+	failErr  error
+}
+
+func splitSegments(start int64, fileSize int64, count int) []*DownloadSegment {
+	remain := fileSize - start
+	segmentSize := (remain + int64(count) - 1) / int64(count)
+	if segmentSize < minSegmentSize {
+		segmentSize = minSegmentSize
+	}
+	segments := []*DownloadSegment{}
+	for start < fileSize {
+		end := start + segmentSize - 1
+		if end >= fileSize {
+			end = fileSize - 1
+		}
+		segments = append(segments, &DownloadSegment{Start: start, End: end})
+		start = end + 1
+	}
+	return segments
+}
+
+// useSegmentDownload the origin must support range and give a validator, otherwise segments may come from different file versions
+func (m *Manager) useSegmentDownload(task *DownloadTask, acceptRanges bool, etag string, lastModified string) bool {
+	return m.config.SegmentCount > 1 &&
+		acceptRanges &&
+		task.FileSize >= m.config.SegmentDownloadThreshold &&
+		ifRangeValidator(etag, lastModified) != ""
+}
+
+func cloneSegments(segments []*DownloadSegment) []*DownloadSegment {
+	list := []*DownloadSegment{}
+	for _, v := range segments {
+		segment := *v
+		list = append(list, &segment)
+	}
+	return list
+}
+
+// prepareSegments reuse the segments of last try if origin file not changed
+func prepareSegments(task *DownloadTask, etag string, lastModified string, count int) []*DownloadSegment {
+	fileInfo, err := os.Stat(tempFilePath(task.SavePath))
+	sameFile := task.ETag == etag && task.LastModified == lastModified
+	if sameFile && len(task.Segments) > 0 && err == nil && fileInfo.Size() == task.FileSize {
+		return task.Segments
+	}
+
+	//continue a single connection partial file
+	start := int64(0)
+	if sameFile && len(task.Segments) == 0 && ifRangeValidator(etag, lastModified) != "" && err == nil && fileInfo.Size() < task.FileSize {
+		start = fileInfo.Size()
+	}
+	segments := splitSegments(start, task.FileSize, count)
+	if start > 0 {
+		segments = append([]*DownloadSegment{{Start: 0, End: start - 1, Downloaded: start}}, segments...)
+	}
+	return segments
+}
+
+func (m *Manager) execSegmentDownload(ctx context.Context, task *DownloadTask, client *http.Client, etag string, lastModified string) ExecResult {
+	segments := prepareSegments(task, etag, lastModified, m.config.SegmentCount)
+	m.taskLock.Lock()
+	task.Segments = segments
+	task.ETag = etag
+	task.LastModified = lastModified
+	m.taskLock.Unlock()
+
+	distFilePath := tempFilePath(task.SavePath)
+	distDir := path.Dir(distFilePath)
+	err := os.MkdirAll(distDir, os.ModePerm)
+	if err != nil {
+		return m.failTaskByError(task, err)
+	}
+	file, err := os.OpenFile(distFilePath, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		logger.Error("open download file error", "err", err, "path", distFilePath)
+		return m.failTaskByError(task, err)
+	}
+	defer file.Close()
+	err = file.Truncate(task.FileSize)
+	if err != nil {
+		logger.Error("truncate download file error", "err", err, "path", distFilePath)
+		return m.failTaskByError(task, err)
+	}
+
+	sd := &segmentDownloader{
+		ctx:       ctx,
+		clock:     m.clock,
+		task:      task,
+		url:       task.source(),
+		client:    client,
+		validator: ifRangeValidator(etag, lastModified),
+		file:      file,
+		limiters:  m.taskLimiters(task),
+		segments:  cloneSegments(segments),
+		running:   map[*segmentRun]bool{},
+	}
+	for _, v := range sd.segments {
+		if v.remain() > 0 {
+			sd.pending = append(sd.pending, v)
+		}
+	}
+	logger.Debug("start segment download", "id", task.Id, "fileSize", task.FileSize, "segments", len(sd.pending))
+
+	m.setStarted(task)
+
+	//every segment connection counts in host limit
+	extra := m.acquireHostConnections(task, m.config.SegmentCount-1)
+	defer m.releaseHostConnections(task, extra)
+
+	_, startDownloaded := sd.progress()
+	wg := sync.WaitGroup{}
+	for i := 0; i < extra+1; i++ {
+		wg.Add(1)
+		go sd.worker(&wg)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	//monitor download speed
+	ticker := m.clock.NewTicker(SpeedInterval)
+	defer ticker.Stop()
+	count := 0
+	stop := ctx.Done()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		case <-stop:
+			//cancelled by LoopScanRunningTask, PauseTask or CancelTask
+			stop = nil
+			sd.closeAll()
+		case <-ticker.C():
+			count++
+			sd.breakSlowSegments()
+
+			segments, downloaded := sd.progress()
+			useTime := count * 1000
+			m.setProgress(task, downloaded, float64(downloaded-startDownloaded)/float64(useTime), segments, useTime)
+		}
+	}
+	segments, downloaded := sd.progress()
+	m.taskLock.Lock()
+	task.Segments = segments
+	task.DownloadedSize = downloaded
+	m.taskLock.Unlock()
+
+	if ctx.Err() != nil {
+		return Break
+	}
+	if sd.failed {
+		return m.failTaskByError(task, sd.failErr)
+	}
+	if downloaded != task.FileSize {
+		logger.Error("segment download size error", "id", task.Id, "downloaded", downloaded, "fileSize", task.FileSize)
+		m.taskLock.Lock()
+		task.Segments = nil
+		m.taskLock.Unlock()
+		return m.failTask(task, FailReason_Incomplete, nil)
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		logger.Error("sync download file error", "err", err, "path", distFilePath)
+		return m.failTaskByError(task, err)
+	}
+	reason := verifyFile(task, distFilePath, downloaded)
+	if reason != "" {
+		logger.Error("download file integrity check fail", "id", task.Id, "reason", reason)
+		os.Remove(distFilePath)
+		m.taskLock.Lock()
+		task.Segments = nil
+		m.taskLock.Unlock()
+		return m.failTask(task, reason, nil)
+	}
+	return m.completeDownload(ctx, task)
+}
+
+// progress copy of segments and downloaded size
+func (sd *segmentDownloader) progress() ([]*DownloadSegment, int64) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	size := int64(0)
+	for _, v := range sd.segments {
+		size += v.Downloaded
+	}
+	return cloneSegments(sd.segments), size
+}
+
+func (sd *segmentDownloader) worker(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		run := sd.next()
+		if run == nil {
+			return
+		}
+		err := sd.download(run)
+
+		sd.lock.Lock()
+		delete(sd.running, run)
+		segment := run.segment
+		//fail caused by cancel is not counted
+		if segment.remain() > 0 && !sd.stop && sd.ctx.Err() == nil {
+			switch {
+			case err == errSegmentBreak:
+				segment.BreakTimes++
+				sd.pending = append(sd.pending, segment)
+			case err == errSegmentRange || isStatusError(err) || segment.FailTimes >= segmentMaxFailTimes:
+				logger.Error("segment download fail", "id", sd.task.Id, "start", segment.Start, "err", err)
+				sd.failed = true
+				sd.failErr = err
+				sd.closeAllLocked()
+			default:
+				segment.FailTimes++
+				sd.pending = append(sd.pending, segment)
+			}
+		}
+		sd.lock.Unlock()
+	}
+}
+
+// next get a pending segment, or split the biggest running one when there is nothing pending
+func (sd *segmentDownloader) next() *segmentRun {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	if sd.stop || sd.ctx.Err() != nil {
+		return nil
+	}
+
+	var segment *DownloadSegment
+	if len(sd.pending) > 0 {
+		segment = sd.pending[0]
+		sd.pending = sd.pending[1:]
+	} else {
+		var biggest *DownloadSegment
+		for run := range sd.running {
+			if biggest == nil || run.segment.remain() > biggest.remain() {
+				biggest = run.segment
+			}
+		}
+		if biggest == nil || biggest.remain() < 2*minSegmentSize {
+			return nil
+		}
+		newStart := biggest.Start + biggest.Downloaded + biggest.remain()/2
+		segment = &DownloadSegment{Start: newStart, End: biggest.End}
+		biggest.End = newStart - 1
+		sd.segments = append(sd.segments, segment)
+	}
+
+	run := &segmentRun{segment: segment, startTime: sd.clock.Now().Unix(), fromDownloaded: segment.Downloaded}
+	sd.running[run] = true
+	return run
+}
+
+func (sd *segmentDownloader) download(run *segmentRun) error {
+	segment := run.segment
+	sd.lock.Lock()
+	from := segment.Start + segment.Downloaded
+	to := segment.End
+	sd.lock.Unlock()
+
+	req, err := http.NewRequestWithContext(sd.ctx, http.MethodGet, sd.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to))
+	req.Header.Set("If-Range", sd.validator)
+	response, err := sd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 400 {
+		logger.Error("segment response error", "id", sd.task.Id, "statusCode", response.StatusCode)
+		return &statusError{code: response.StatusCode}
+	}
+	if response.StatusCode != 206 || contentRangeStart(response.Header.Get("Content-Range")) != from {
+		logger.Error("segment response error", "id", sd.task.Id, "statusCode", response.StatusCode, "contentRange", response.Header.Get("Content-Range"))
+		return errSegmentRange
+	}
+
+	sd.lock.Lock()
+	run.body = response.Body
+	broken := run.broken || sd.stop
+	sd.lock.Unlock()
+	if broken {
+		return errSegmentBreak
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		nr, er := response.Body.Read(buf)
+		if nr > 0 {
+			err := waitLimiters(sd.ctx, nr, sd.limiters...)
+			if err != nil {
+				return err
+			}
+			sd.lock.Lock()
+			pos := segment.Start + segment.Downloaded
+			//End may be moved forward by split
+			limit := segment.End - pos + 1
+			sd.lock.Unlock()
+			if int64(nr) > limit {
+				nr = int(limit)
+			}
+			nw, ew := sd.file.WriteAt(buf[:nr], pos)
+			sd.lock.Lock()
+			segment.Downloaded += int64(nw)
+			finished := segment.remain() <= 0
+			sd.lock.Unlock()
+			if ew != nil {
+				return ew
+			}
+			if finished {
+				return nil
+			}
+		}
+		if er != nil {
+			sd.lock.Lock()
+			broken := run.broken || sd.stop
+			sd.lock.Unlock()
+			if broken {
+				return errSegmentBreak
+			}
+			if er == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return er
+		}
+	}
+}
+
+func (sd *segmentDownloader) closeAll() {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	sd.closeAllLocked()
+}
+
+func (sd *segmentDownloader) closeAllLocked() {
+	sd.stop = true
+	for run := range sd.running {
+		run.broken = true
+		if run.body != nil {
+			run.body.Close()
+		}
+	}
+}
+
+// breakSlowSegments same as LoopScanRunningTask, a slow connection is closed and its remain part goes back to pending
+func (sd *segmentDownloader) breakSlowSegments() {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	if len(sd.running) < 2 {
+		return
+	}
+
+	nowTime := sd.clock.Now().Unix()
+	speeds := map[*segmentRun]float64{}
+	totalSpeed := float64(0)
+	for run := range sd.running {
+		useTime := nowTime - run.startTime
+		if useTime < 5 || run.body == nil {
+			continue
+		}
+		speed := float64(run.segment.Downloaded-run.fromDownloaded) / float64(useTime*1000)
+		speeds[run] = speed
+		totalSpeed += speed
+	}
+	if len(speeds) < 2 {
+		return
+	}
+
+	averageSpeed := totalSpeed / float64(len(speeds))
+	for run, speed := range speeds {
+		if speed*segmentSlowRatio >= averageSpeed ||
+			run.broken ||
+			run.segment.BreakTimes >= segmentMaxBreakTimes ||
+			run.segment.remain() < minSegmentSize {
+			continue
+		}
+		logger.Debug("break slow segment", "id", sd.task.Id, "start", run.segment.Start, "speed", speed, "average", averageSpeed)
+		run.broken = true
+		run.body.Close()
+	}
+}
@@ -0,0 +1,77 @@
+package downloadtaskmgr
+
+import (
+	"context"
+	"errors"
+
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+var ErrManagerClosed = errors.New("download manager is shut down")
+
+func (m *Manager) isClosing() bool {
+	m.taskLock.Lock()
+	defer m.taskLock.Unlock()
+	return m.closing
+}
+
+// Shutdown stop accepting tasks and wait running tasks until ctx is done,
+// tasks still running then are interrupted and checkpointed.
+// All tasks are saved to leveldb and leveldb is closed before return.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.taskLock.Lock()
+	if m.closing {
+		m.taskLock.Unlock()
+		return ErrManagerClosed
+	}
+	m.closing = true
+	close(m.stopChan)
+	//tasks waiting for retry or NotBefore are queued again after restart
+	for id, timer := range m.retryTimers {
+		timer.Stop()
+		delete(m.retryTimers, id)
+	}
+	m.taskLock.Unlock()
+	logger.Debug("download manager shutting down")
+
+	//no more task is taken out from queues
+	m.loopWg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		m.taskWg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		logger.Debug("shutdown timeout, break running tasks")
+		m.taskMap.Range(func(key, value interface{}) bool {
+			m.breakRunningTask(value.(*DownloadTask), StopReason_Shutdown)
+			return true
+		})
+		<-done
+	}
+
+	//save state of all unfinished tasks
+	tasks := []*DownloadTask{}
+	m.taskMap.Range(func(key, value interface{}) bool {
+		tasks = append(tasks, value.(*DownloadTask))
+		return true
+	})
+	if len(tasks) > 0 {
+		saveErr := m.SetTasksToLDB(tasks)
+		if err == nil {
+			err = saveErr
+		}
+	}
+	closeErr := m.CloseLDB()
+	if err == nil {
+		err = closeErr
+	}
+	logger.Debug("download manager shut down", "unfinished", len(tasks))
+	return err
+}
@@ -0,0 +1,83 @@
+package downloadtaskmgr
+
+import (
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+const Event_SourceChanged EventType = "source_changed"
+
+// sources TargetUrl and then Sources, duplicated urls are removed
+func (t *DownloadTask) sources() []string {
+	list := []string{}
+	exist := map[string]bool{}
+	for _, v := range append([]string{t.TargetUrl}, t.Sources...) {
+		if v == "" || exist[v] {
+			continue
+		}
+		exist[v] = true
+		list = append(list, v)
+	}
+	return list
+}
+
+// source url of this try
+func (t *DownloadTask) source() string {
+	list := t.sources()
+	if t.SourceIndex < 0 || t.SourceIndex >= len(list) {
+		return t.TargetUrl
+	}
+	return list[t.SourceIndex]
+}
+
+func (t *DownloadTask) hasNextSource() bool {
+	return t.SourceIndex+1 < len(t.sources())
+}
+
+// sourceFailed fail of local disk is not fixed by another source
+func sourceFailed(reason FailReason) bool {
+	switch reason {
+	case FailReason_NoSpace, FailReason_DiskFull, FailReason_FileError, FailReason_PostProcess:
+		return false
+	}
+	return true
+}
+
+// TaskSwitchSource try the next source at once, it is not counted as a retry
+func (m *Manager) TaskSwitchSource(task *DownloadTask) {
+	m.DeleteDownloadingTask(task.Id)
+	m.taskLock.Lock()
+	from := task.source()
+	task.SourceIndex++
+	//partial file of another source is not trusted
+	task.DownloadedSize = 0
+	task.Segments = nil
+	to := task.source()
+	reason := task.FailReason
+	m.taskLock.Unlock()
+	m.SetTaskToLDB(task)
+	logger.Debug("Task Switch Source", "id", task.Id, "from", from, "to", to, "reason", reason)
+	m.publish(Event_SourceChanged, task, 0)
+	m.queueTask(task, nil)
+}
+
+// breakSlowSources break tasks which are slower than Config.SlowSourceKBs and have another source
+func (m *Manager) breakSlowSources() {
+	if m.config.SlowSourceKBs <= 0 {
+		return
+	}
+	nowTime := m.clock.Now().Unix()
+	m.taskMap.Range(func(key, value interface{}) bool {
+		task := value.(*DownloadTask)
+		m.taskLock.Lock()
+		defer m.taskLock.Unlock()
+		slow := task.Status == Task_Downloading && task.PostProcessor == "" &&
+			task.StartTime > 0 &&
+			nowTime-task.StartTime >= m.config.SlowSourceCheckSec &&
+			task.SpeedKBs < float64(m.config.SlowSourceKBs) &&
+			task.hasNextSource()
+		if slow && m.breakRunningTaskLocked(task, StopReason_SlowSource) {
+			logger.Debug("source too slow", "id", task.Id, "source", task.source(), "speed", task.SpeedKBs)
+		}
+		return true
+	})
+}
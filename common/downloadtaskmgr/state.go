@@ -0,0 +1,133 @@
+package downloadtaskmgr
+
+import (
+	"sort"
+)
+
+// TaskState where the task is now
+type TaskState string
+
+const (
+	TaskState_Queued     TaskState = "queued"     //global queue
+	TaskState_Idle       TaskState = "idle"       //idle queue of a channel
+	TaskState_Running    TaskState = "running"    //downloading
+	TaskState_Processing TaskState = "processing" //downloaded, post processors running
+	TaskState_Waiting    TaskState = "waiting"    //waiting for retry or disk space
+	TaskState_Scheduled  TaskState = "scheduled"  //waiting for NotBefore
+	TaskState_Paused     TaskState = "paused"
+)
+
+type TaskSummary struct {
+	Task     DownloadTask
+	State    TaskState
+	Channel  int     //index of channel, -1 means not in a channel
+	Progress float64 //percent, 0 if file size unknown
+}
+
+type ChannelState struct {
+	Index         int
+	SpeedLimitKBs int64
+	MaxSpeedKBs   int64
+	CountLimit    int
+	Running       int
+	Idle          int
+	IdleCapacity  int
+}
+
+// Occupancy of the global queue and all channels
+type Occupancy struct {
+	Queued             int //waiting in global queue
+	NewTaskCountLimit  int
+	NewTaskRunning     int
+	MaxSpeedKBs        int64
+	NewTaskMaxSpeedKBs int64
+	Channels           []ChannelState
+}
+
+func (m *Manager) channelIndex(channel *DownloadChannel) int {
+	for i, v := range m.channelArray {
+		if v == channel {
+			return i
+		}
+	}
+	return -1
+}
+
+// ListTasks all unfinished tasks order by id
+func (m *Manager) ListTasks() []TaskSummary {
+	tasks := []*DownloadTask{}
+	m.taskMap.Range(func(key, value interface{}) bool {
+		tasks = append(tasks, value.(*DownloadTask))
+		return true
+	})
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Id < tasks[j].Id })
+
+	list := []TaskSummary{}
+	for _, v := range tasks {
+		m.taskLock.Lock()
+		summary := TaskSummary{Task: v.snapshot(), Channel: -1}
+		channel, inQueue := m.queuedTasks[v.Id]
+		_, waiting := m.retryTimers[v.Id]
+		switch {
+		case v.Status == Task_Cancelled:
+			m.taskLock.Unlock()
+			continue
+		case v.Status == Task_Paused:
+			summary.State = TaskState_Paused
+		case v.Status == Task_Downloading && v.PostProcessor != "":
+			summary.State = TaskState_Processing
+			summary.Channel = m.channelIndex(v.runningChannel)
+		case v.Status == Task_Downloading:
+			summary.State = TaskState_Running
+			summary.Channel = m.channelIndex(v.runningChannel)
+		case inQueue && channel != nil:
+			summary.State = TaskState_Idle
+			summary.Channel = m.channelIndex(channel)
+		case waiting && v.NotBefore > m.clock.Now().Unix():
+			summary.State = TaskState_Scheduled
+		case waiting:
+			summary.State = TaskState_Waiting
+		default:
+			summary.State = TaskState_Queued
+		}
+		m.taskLock.Unlock()
+
+		if summary.Task.FileSize > 0 {
+			summary.Progress = float64(summary.Task.DownloadedSize) * 100 / float64(summary.Task.FileSize)
+		}
+		list = append(list, summary)
+	}
+	return list
+}
+
+func (m *Manager) GetOccupancy() Occupancy {
+	o := Occupancy{
+		Queued:             m.scheduler.len(),
+		NewTaskCountLimit:  m.config.NewRunningTaskCount,
+		MaxSpeedKBs:        m.globalLimiter.Limit(),
+		NewTaskMaxSpeedKBs: m.newTaskLimiter.Limit(),
+	}
+	running := map[*DownloadChannel]int{}
+	m.taskMap.Range(func(key, value interface{}) bool {
+		task := value.(*DownloadTask)
+		m.taskLock.Lock()
+		if task.Status == Task_Downloading {
+			running[task.runningChannel]++
+		}
+		m.taskLock.Unlock()
+		return true
+	})
+	o.NewTaskRunning = running[nil]
+	for i, v := range m.channelArray {
+		o.Channels = append(o.Channels, ChannelState{
+			Index:         i,
+			SpeedLimitKBs: v.SpeedLimitKBs,
+			MaxSpeedKBs:   v.limiter.Limit(),
+			CountLimit:    v.CountLimit,
+			Running:       running[v],
+			Idle:          len(v.IdleChan),
+			IdleCapacity:  cap(v.IdleChan),
+		})
+	}
+	return o
+}
@@ -0,0 +1,333 @@
+package downloadtaskmgr
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+var ErrTaskNotExist = errors.New("task not exist")
+var ErrTaskCancelled = errors.New("task already cancelled")
+var ErrTaskRunning = errors.New("task is running")
+
+// GetTask return a copy of the unfinished task, changing it does not affect the download
+func (m *Manager) GetTask(id uint64) *DownloadTask {
+	task := m.loadTask(id)
+	if task == nil {
+		return nil
+	}
+	return m.snapshotTask(task)
+}
+
+// loadTask return the task which is changed by download, fields must be read with taskLock
+func (m *Manager) loadTask(id uint64) *DownloadTask {
+	value, exist := m.taskMap.Load(id)
+	if !exist {
+		return nil
+	}
+	return value.(*DownloadTask)
+}
+
+// CancelTask stop the task wherever it is, the record and partial file are deleted.
+// A queued task is cleaned at once and its file can be added again, a running task is cleaned after its download stops,
+// which is told by Event_Cancelled.
+func (m *Manager) CancelTask(id uint64) error {
+	task := m.loadTask(id)
+	if task == nil {
+		return ErrTaskNotExist
+	}
+
+	m.taskLock.Lock()
+	status := task.Status
+	if status == Task_Cancelled {
+		m.taskLock.Unlock()
+		return ErrTaskCancelled
+	}
+	task.Status = Task_Cancelled
+	m.removeFromScheduler(task)
+	m.stopRetryTimerLocked(id)
+	logger.Debug("cancel task", "id", id, "status", status)
+	if status == Task_Downloading {
+		//StartTask will clean it after download stopped
+		m.stopRunLocked(id, StopReason_Cancelled)
+		m.taskLock.Unlock()
+		return nil
+	}
+	//task in queue will be dropped when it is taken out
+	m.cleanCancelledTaskLocked(task)
+	m.taskLock.Unlock()
+
+	//give back the host connection kept for it
+	m.releaseHost(task)
+	return nil
+}
+
+// CancelTaskByFile cancel all tasks download the file, return cancelled count
+func (m *Manager) CancelTaskByFile(bindName string, fileName string) int {
+	ids := []uint64{}
+	m.taskMap.Range(func(key, value interface{}) bool {
+		task := value.(*DownloadTask)
+		if task.BindName == bindName && task.FileName == fileName {
+			ids = append(ids, task.Id)
+		}
+		return true
+	})
+
+	count := 0
+	for _, id := range ids {
+		if m.CancelTask(id) == nil {
+			count++
+		}
+	}
+	return count
+}
+
+// PauseTask stop the task and keep the partial file until ResumeTask
+func (m *Manager) PauseTask(id uint64) error {
+	task := m.loadTask(id)
+	if task == nil {
+		return ErrTaskNotExist
+	}
+
+	m.taskLock.Lock()
+	status := task.Status
+	switch status {
+	case Task_Cancelled:
+		m.taskLock.Unlock()
+		return ErrTaskCancelled
+	case Task_Paused:
+		m.taskLock.Unlock()
+		return nil
+	}
+	task.Status = Task_Paused
+	m.removeFromScheduler(task)
+	if status == Task_Downloading {
+		m.stopRunLocked(id, StopReason_Paused)
+	}
+	m.taskLock.Unlock()
+
+	logger.Debug("pause task", "id", id, "status", status)
+	//running task saves its progress again after download stopped
+	m.SetTaskToLDB(task)
+	m.publish(Event_Paused, task, 0)
+	if status == Task_Downloading {
+		return nil
+	}
+	m.releaseHost(task)
+	return nil
+}
+
+func (m *Manager) ResumeTask(id uint64) error {
+	task := m.loadTask(id)
+	if task == nil {
+		return ErrTaskNotExist
+	}
+
+	m.taskLock.Lock()
+	switch task.Status {
+	case Task_Cancelled:
+		m.taskLock.Unlock()
+		return ErrTaskCancelled
+	case Task_Paused:
+	default:
+		m.taskLock.Unlock()
+		return nil
+	}
+	//paused run is still stopping, StartTask queues it again like a broken task
+	if _, running := m.runs[id]; running {
+		task.Status = Task_Downloading
+		m.taskLock.Unlock()
+		logger.Debug("resume stopping task", "id", id)
+		m.SetTaskToLDB(task)
+		return nil
+	}
+	task.Status = Task_UnStart
+	_, inQueue := m.queuedTasks[id]
+	m.taskLock.Unlock()
+
+	logger.Debug("resume task", "id", id)
+	m.SetTaskToLDB(task)
+	//still in queue, it will run when taken out
+	if !inQueue {
+		m.queueTask(task, task.DownloadChannel)
+	}
+	return nil
+}
+
+// queueTask put task into idle queue of channel, or global queue if channel is nil
+func (m *Manager) queueTask(task *DownloadTask, channel *DownloadChannel) {
+	m.taskLock.Lock()
+	if m.handleStoppedTaskLocked(task) {
+		//may be waiting for retry
+		delete(m.queuedTasks, task.Id)
+		m.taskLock.Unlock()
+		return
+	}
+	task.Status = Task_UnStart
+	//shutting down, task is saved in leveldb and queued or expired after restart
+	if m.closing {
+		m.taskLock.Unlock()
+		return
+	}
+	if task.expired(m.clock.Now()) {
+		m.expireTaskLocked(task)
+		m.taskLock.Unlock()
+		m.expireTask(task)
+		return
+	}
+	//scheduled task waits for NotBefore
+	if delay := m.notBeforeDelay(task); channel == nil && delay > 0 {
+		m.queueTaskAfterLocked(task, delay)
+		m.taskLock.Unlock()
+		m.publish(Event_Scheduled, task, 0)
+		return
+	}
+	m.queuedTasks[task.Id] = channel
+	m.taskLock.Unlock()
+
+	m.publish(Event_Queued, task, 0)
+	if channel == nil {
+		m.scheduler.push(task)
+		return
+	}
+	channel.IdleChan <- task
+}
+
+// queueTaskAfter queue task into global queue after delay
+func (m *Manager) queueTaskAfter(task *DownloadTask, delay time.Duration) {
+	if delay <= 0 {
+		m.queueTask(task, nil)
+		return
+	}
+
+	m.taskLock.Lock()
+	m.queueTaskAfterLocked(task, delay)
+	m.taskLock.Unlock()
+}
+
+// stopRetryTimerLocked task waiting for retry or NotBefore is not queued any more
+func (m *Manager) stopRetryTimerLocked(id uint64) {
+	timer, waiting := m.retryTimers[id]
+	if !waiting {
+		return
+	}
+	timer.Stop()
+	delete(m.retryTimers, id)
+	delete(m.queuedTasks, id)
+}
+
+func (m *Manager) queueTaskAfterLocked(task *DownloadTask, delay time.Duration) {
+	task.Status = Task_UnStart
+	//timers are stopped by Shutdown, task is saved in leveldb and queued again after restart
+	if m.closing {
+		return
+	}
+	//count as queued while waiting, so ResumeTask will not queue it twice
+	m.queuedTasks[task.Id] = nil
+	m.retryTimers[task.Id] = m.clock.AfterFunc(delay, func() {
+		m.taskLock.Lock()
+		delete(m.retryTimers, task.Id)
+		m.taskLock.Unlock()
+		m.queueTask(task, nil)
+	})
+}
+
+// RetryTask queue a paused task or a task waiting for retry at once, its try count is reset.
+// A recently failed task is queued again with the same id and downloaded from beginning, see Config.KeepFailedTasks.
+func (m *Manager) RetryTask(id uint64) error {
+	task := m.loadTask(id)
+	if task == nil {
+		return m.retryFailedTask(id)
+	}
+
+	m.taskLock.Lock()
+	switch task.Status {
+	case Task_Cancelled:
+		m.taskLock.Unlock()
+		return ErrTaskCancelled
+	case Task_Downloading:
+		m.taskLock.Unlock()
+		return ErrTaskRunning
+	case Task_Paused:
+		task.TryTimes = 0
+		m.taskLock.Unlock()
+		return m.ResumeTask(id)
+	}
+	timer, waiting := m.retryTimers[id]
+	if !waiting || !timer.Stop() {
+		//already in queue
+		m.taskLock.Unlock()
+		return nil
+	}
+	delete(m.retryTimers, id)
+	delete(m.queuedTasks, id)
+	task.TryTimes = 0
+	m.taskLock.Unlock()
+
+	logger.Debug("retry task", "id", id)
+	m.SetTaskToLDB(task)
+	m.queueTask(task, nil)
+	return nil
+}
+
+// removeFromScheduler stopped task leaves global queue at once, task in channel idle queue is dropped when taken out
+func (m *Manager) removeFromScheduler(task *DownloadTask) {
+	if m.scheduler.remove(task.Id) != nil {
+		delete(m.queuedTasks, task.Id)
+	}
+}
+
+// dequeueTask is called when task taken out from queue, return false if task should not run.
+// channel is where the task runs, nil means running as new task.
+func (m *Manager) dequeueTask(task *DownloadTask, channel *DownloadChannel) bool {
+	m.taskLock.Lock()
+	defer m.taskLock.Unlock()
+	delete(m.queuedTasks, task.Id)
+	switch task.Status {
+	case Task_Cancelled, Task_Paused, Task_Expired:
+		logger.Debug("drop stopped task from queue", "id", task.Id, "status", task.Status)
+		return false
+	}
+	task.Status = Task_Downloading
+	task.runningChannel = channel
+	return true
+}
+
+// handleStoppedTaskLocked is called after task stop running, return true if it is paused or cancelled
+func (m *Manager) handleStoppedTaskLocked(task *DownloadTask) bool {
+	switch task.Status {
+	case Task_Paused:
+		m.DeleteDownloadingTask(task.Id)
+		m.setTaskToLDBLocked(task)
+		logger.Debug("Task Paused", "id", task.Id, "downloaded", task.DownloadedSize)
+		return true
+	case Task_Cancelled:
+		m.cleanCancelledTaskLocked(task)
+		return true
+	case Task_Expired:
+		//failed by expireTask
+		return true
+	}
+	return false
+}
+
+func (m *Manager) cleanCancelledTaskLocked(task *DownloadTask) {
+	logger.Debug("Task Cancelled", "id", task.Id)
+	m.DelTaskFromLDB(task.Id)
+	m.DeleteDownloadingTask(task.Id)
+	_, exist := m.taskMap.LoadAndDelete(task.Id)
+	//cleaned again when taken out from queue, the file may belong to a new task of the same SavePath now
+	if !exist {
+		return
+	}
+	os.Remove(tempFilePath(task.SavePath))
+	m.publishLocked(Event_Cancelled, task, 0)
+	//the same file can be added again as soon as CancelTask returns, callbacks run outside taskLock
+	callbacks := m.unindexTask(task)
+	if len(callbacks) > 0 {
+		snapshot := task.snapshot()
+		go runDoneCallbacks(&snapshot, callbacks, false)
+	}
+}
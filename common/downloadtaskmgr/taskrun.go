@@ -0,0 +1,118 @@
+package downloadtaskmgr
+
+import (
+	"context"
+	"time"
+)
+
+// StopReason why a running task is interrupted
+type StopReason string
+
+const (
+	StopReason_Evicted    StopReason = "evicted"     //moved to a slower channel by LoopScanRunningTask
+	StopReason_SlowSource StopReason = "slow_source" //moved to next source
+	StopReason_Paused     StopReason = "paused"
+	StopReason_Cancelled  StopReason = "cancelled"
+	StopReason_Shutdown   StopReason = "shutdown"
+	StopReason_Expired    StopReason = "expired" //Deadline passed
+)
+
+// taskRun one run of a task, download is stopped by cancelling its context
+type taskRun struct {
+	cancel context.CancelFunc
+	reason StopReason
+}
+
+// startRun return the context of this run, it is cancelled at once if the task is stopped before running
+func (m *Manager) startRun(task *DownloadTask) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.taskLock.Lock()
+	defer m.taskLock.Unlock()
+	m.runs[task.Id] = &taskRun{cancel: cancel}
+	//values of last run, StartTime is set again when body starts
+	task.StartTime = 0
+	task.SpeedKBs = 0
+	task.ZeroSpeedSec = 0
+	switch task.Status {
+	case Task_Paused:
+		m.stopRunLocked(task.Id, StopReason_Paused)
+	case Task_Cancelled:
+		m.stopRunLocked(task.Id, StopReason_Cancelled)
+	default:
+		if task.expired(m.clock.Now()) {
+			m.stopRunLocked(task.Id, StopReason_Expired)
+		}
+	}
+	return ctx
+}
+
+// endRun return why the run was stopped, empty if it was not stopped.
+// The run is removed by StartTask when the stopped task is handled, so ResumeTask knows it is still stopping.
+func (m *Manager) endRun(task *DownloadTask) StopReason {
+	m.taskLock.Lock()
+	run, exist := m.runs[task.Id]
+	m.taskLock.Unlock()
+	if !exist {
+		return ""
+	}
+	run.cancel()
+	return run.reason
+}
+
+// stopRunLocked cancel the running download, the last reason wins
+func (m *Manager) stopRunLocked(id uint64, reason StopReason) {
+	run, exist := m.runs[id]
+	if !exist {
+		return
+	}
+	run.reason = reason
+	run.cancel()
+}
+
+// breakRunningTaskLocked interrupt a downloading task, the task keeps its progress and is queued again
+func (m *Manager) breakRunningTaskLocked(task *DownloadTask, reason StopReason) bool {
+	//may be paused or cancelled by user
+	if task.Status != Task_Downloading {
+		return false
+	}
+	task.Status = Task_Break
+	m.stopRunLocked(task.Id, reason)
+	return true
+}
+
+func (m *Manager) breakRunningTask(task *DownloadTask, reason StopReason) bool {
+	m.taskLock.Lock()
+	defer m.taskLock.Unlock()
+	return m.breakRunningTaskLocked(task, reason)
+}
+
+// setProgress is called by the speed monitor of a running task every second,
+// segments is a copy of segmented download and nil for single connection
+func (m *Manager) setProgress(task *DownloadTask, downloaded int64, speedKBs float64, segments []*DownloadSegment, useTime int) {
+	m.taskLock.Lock()
+	task.DownloadedSize = downloaded
+	task.SpeedKBs = speedKBs
+	if segments != nil {
+		task.Segments = segments
+	}
+	m.taskLock.Unlock()
+	m.updateSpace(task.Id, downloaded)
+
+	m.publish(Event_Progress, task, time.Duration(useTime)*time.Millisecond)
+	if m.onDownloading != nil {
+		go m.onDownloading(m.snapshotTask(task), useTime)
+	}
+}
+
+// setStarted is called when the download body starts, validators and segments are saved so the file can be continued after a crash
+func (m *Manager) setStarted(task *DownloadTask) {
+	m.taskLock.Lock()
+	task.StartTime = m.clock.Now().Unix()
+	m.taskLock.Unlock()
+	m.SetTaskToLDB(task)
+
+	m.publish(Event_Started, task, 0)
+	if m.onDownloadStart != nil {
+		go m.onDownloadStart(m.snapshotTask(task))
+	}
+}
@@ -0,0 +1,77 @@
+package downloadtaskmgr
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/daqnext/meson-common/common/logger"
+	"github.com/daqnext/meson-common/common/utils"
+)
+
+// TempFileMark downloading file is written to "name.downloading.ext" and renamed to SavePath when finished
+const TempFileMark = ".downloading"
+
+func tempFilePath(savePath string) string {
+	return utils.FileAddMark(savePath, TempFileMark)
+}
+
+// commitDownloadFile move the finished temp file to SavePath, file must be synced and closed before
+func commitDownloadFile(task *DownloadTask) error {
+	err := os.Rename(tempFilePath(task.SavePath), task.SavePath)
+	if err != nil {
+		logger.Error("rename download file error", "err", err, "id", task.Id, "path", task.SavePath)
+	}
+	return err
+}
+
+// isTempFileName name is in the form made by tempFilePath
+func isTempFileName(name string) bool {
+	ext := filepath.Ext(name)
+	if ext == TempFileMark {
+		//no extension
+		return len(name) > len(TempFileMark)
+	}
+	base := name[:len(name)-len(ext)]
+	return len(base) > len(TempFileMark) && strings.HasSuffix(base, TempFileMark)
+}
+
+func absPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return filepath.Clean(p)
+	}
+	return abs
+}
+
+// cleanTempFiles remove temp files under rootPath which do not belong to an unfinished task,
+// files of other managers saving under rootPath would be removed too, so it only runs if Config.CleanTempFiles
+func cleanTempFiles(rootPath string, tasks []*DownloadTask) {
+	if rootPath == "" || !utils.Exists(rootPath) {
+		return
+	}
+	keep := map[string]bool{}
+	for _, v := range tasks {
+		keep[absPath(tempFilePath(v.SavePath))] = true
+	}
+
+	count := 0
+	filepath.Walk(absPath(rootPath), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if !isTempFileName(info.Name()) || keep[path] {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			logger.Error("remove stale temp file error", "err", err, "path", path)
+			return nil
+		}
+		count++
+		return nil
+	})
+	if count > 0 {
+		logger.Debug("stale temp files removed", "count", count, "root", rootPath)
+	}
+}
@@ -0,0 +1,200 @@
+package downloadtaskmgr
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/daqnext/meson-common/common/enum/envtype"
+	"github.com/daqnext/meson-common/common/logger"
+)
+
+var ErrInsecureNotAllowed = errors.New("insecure skip verify is only allowed in dev env")
+
+// TransportConfig of the http client shared by HEAD and GET requests of all tasks
+type TransportConfig struct {
+	Env                envtype.EEnv
+	ProxyUrl           string //http, https or socks5 proxy, empty means direct
+	CAFile             string //pem bundle trusted besides system roots
+	InsecureSkipVerify bool   //only allowed when Env is dev or localdev
+	//direct connections only, the proxy resolves and dials origin itself
+	ResolveOverrides map[string]string //url host -> ip to dial, e.g. pinned by utils.GetUrlIp
+	ServerNames      map[string]string //url host -> TLS server name (SNI)
+	EnableHTTP2      bool
+	ConnectTimeout   time.Duration //0 means 10s
+	ReadWriteTimeout time.Duration //deadline of a connection since dialed, 0 means 12h
+}
+
+func isDevEnv(env envtype.EEnv) bool {
+	return env == envtype.Dev || env == envtype.LocalDev
+}
+
+// newHttpClient build the client of config, errors of proxy url and ca file are returned
+func newHttpClient(config TransportConfig) (*http.Client, error) {
+	if config.InsecureSkipVerify && !isDevEnv(config.Env) {
+		return nil, ErrInsecureNotAllowed
+	}
+	connectTimeout := config.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = 10 * time.Second
+	}
+	readWriteTimeout := config.ReadWriteTimeout
+	if readWriteTimeout <= 0 {
+		readWriteTimeout = 3600 * 12 * time.Second
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in ca file " + config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := &http.Transport{
+		DialContext:         resolveDialer(connectTimeout, readWriteTimeout, copyHostMap(config.ResolveOverrides)),
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: connectTimeout,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   config.EnableHTTP2,
+	}
+	if !config.EnableHTTP2 {
+		//non-nil empty map turns off http2
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if config.ProxyUrl != "" {
+		proxyUrl, err := url.Parse(config.ProxyUrl)
+		if err != nil {
+			return nil, err
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, errors.New("unsupported proxy " + config.ProxyUrl)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if len(config.ServerNames) > 0 {
+		transport.DialTLSContext = serverNameDialer(transport, copyHostMap(config.ServerNames))
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+func copyHostMap(hosts map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range hosts {
+		result[k] = v
+	}
+	return result
+}
+
+// resolveDialer is TimeoutDialer dialing the ip in overrides instead of resolving the host
+func resolveDialer(cTimeout time.Duration, rwTimeout time.Duration, overrides map[string]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: cTimeout}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if ip, exist := overrides[host]; exist {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if rwTimeout > 0 {
+			err := conn.SetDeadline(time.Now().Add(rwTimeout))
+			if err != nil {
+				logger.Error("set download process rwTimeout error", "err", err)
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
+
+// serverNameDialer dial https of direct connections, hosts in serverNames send their own SNI
+func serverNameDialer(transport *http.Transport, serverNames map[string]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := transport.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		//NextProtos has h2 added by transport when http2 is on
+		tlsConfig := transport.TLSClientConfig.Clone()
+		tlsConfig.ServerName = host
+		if name, exist := serverNames[host]; exist {
+			tlsConfig.ServerName = name
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		ctx, cancel := context.WithTimeout(ctx, transport.TLSHandshakeTimeout)
+		defer cancel()
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- tlsConn.Handshake()
+		}()
+		select {
+		case err = <-errChan:
+		case <-ctx.Done():
+			conn.Close()
+			<-errChan
+			err = ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// httpClient of current TransportConfig
+func (m *Manager) httpClient() *http.Client {
+	m.clientLock.Lock()
+	defer m.clientLock.Unlock()
+	if m.client == nil {
+		//Init not called, config error is reported by Init
+		client, err := newHttpClient(m.config.Transport)
+		if err != nil {
+			logger.Error("download transport config error", "err", err)
+			client, _ = newHttpClient(TransportConfig{})
+		}
+		m.client = client
+	}
+	return m.client
+}
+
+// SetTransportConfig change the http client at runtime, running tasks keep the old one until they stop
+func (m *Manager) SetTransportConfig(config TransportConfig) error {
+	client, err := newHttpClient(config)
+	if err != nil {
+		return err
+	}
+	m.clientLock.Lock()
+	old := m.client
+	m.client = client
+	m.clientLock.Unlock()
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package downloadtaskmgr
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	HashMd5    = "md5"
+	HashSha256 = "sha256"
+)
+
+type FailReason string
+
+const FailReason_SizeMismatch FailReason = "size_mismatch"
+const FailReason_HashMismatch FailReason = "hash_mismatch"
+
+var errSizeMismatch = errors.New(string(FailReason_SizeMismatch))
+
+func checkHashType(hashType string) error {
+	switch strings.ToLower(hashType) {
+	case "", HashMd5, HashSha256:
+		return nil
+	}
+	return errors.New("unsupported hash type " + hashType)
+}
+
+func newHash(hashType string) hash.Hash {
+	switch strings.ToLower(hashType) {
+	case HashSha256:
+		return sha256.New()
+	default:
+		//same as utils.HashLocalFile
+		return md5.New()
+	}
+}
+
+// integrityVerifier hash the file content while it is being downloaded
+type integrityVerifier struct {
+	task *DownloadTask
+	hash hash.Hash
+	//bytes need to be hashed, -1 means whole file
+	limit int64
+	//bytes passed through
+	size int64
+}
+
+func newIntegrityVerifier(task *DownloadTask) *integrityVerifier {
+	v := &integrityVerifier{task: task, limit: -1}
+	if task.ExpectedHash != "" {
+		v.hash = newHash(task.HashType)
+		if task.HashBytes > 0 {
+			v.limit = task.HashBytes
+		}
+	}
+	return v
+}
+
+// prime feed the already downloaded part of a resumed file
+func (v *integrityVerifier) prime(filePath string, offset int64) error {
+	if offset <= 0 {
+		return nil
+	}
+	if v.hash != nil {
+		hashSize := offset
+		if v.limit >= 0 && v.limit < hashSize {
+			hashSize = v.limit
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		n, err := io.CopyN(v.hash, file, hashSize)
+		if err != nil {
+			return err
+		}
+		if n != hashSize {
+			return io.ErrUnexpectedEOF
+		}
+	}
+	v.size = offset
+	return nil
+}
+
+func (v *integrityVerifier) Write(p []byte) (int, error) {
+	if v.hash != nil {
+		toHash := p
+		if v.limit >= 0 {
+			left := v.limit - v.size
+			if left < 0 {
+				left = 0
+			}
+			if int64(len(toHash)) > left {
+				toHash = toHash[:left]
+			}
+		}
+		v.hash.Write(toHash)
+	}
+	v.size += int64(len(p))
+	if v.task.ExpectedSize > 0 && v.size > v.task.ExpectedSize {
+		return len(p), errSizeMismatch
+	}
+	return len(p), nil
+}
+
+func (v *integrityVerifier) hashMatch() bool {
+	if v.hash == nil {
+		return true
+	}
+	return strings.EqualFold(hex.EncodeToString(v.hash.Sum(nil)), v.task.ExpectedHash)
+}
+
+// check return the fail reason, empty means file is ok
+func (v *integrityVerifier) check(size int64) FailReason {
+	if v.task.ExpectedSize > 0 && size != v.task.ExpectedSize {
+		return FailReason_SizeMismatch
+	}
+	if !v.hashMatch() {
+		return FailReason_HashMismatch
+	}
+	return ""
+}
+
+// verifyFile check a file which is not downloaded sequentially, like segment download
+func verifyFile(task *DownloadTask, filePath string, size int64) FailReason {
+	v := newIntegrityVerifier(task)
+	if v.hash != nil {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return FailReason_HashMismatch
+		}
+		defer file.Close()
+		var reader io.Reader = file
+		if v.limit >= 0 {
+			reader = io.LimitReader(file, v.limit)
+		}
+		_, err = io.Copy(v.hash, reader)
+		if err != nil {
+			return FailReason_HashMismatch
+		}
+	}
+	return v.check(size)
+}
+
+// verifyingReadCloser pass the response body through verifier, stop at once when size exceed
+type verifyingReadCloser struct {
+	io.ReadCloser
+	verifier *integrityVerifier
+}
+
+func (r *verifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		_, ew := r.verifier.Write(p[:n])
+		if ew != nil {
+			return n, ew
+		}
+	}
+	return n, err
+}
@@ -88,6 +88,11 @@ const (
 
 	addDownloadTaskFailed = 4001
 	noEnoughSpace         = 4002
+	downloadTaskNotExist  = 4003
+	downloadTaskExist     = 4004
+	downloadQueueFull     = 4005
+	downloadTaskStopped   = 4006
+	downloadTaskRunning   = 4007
 )
 
 var (
@@ -156,4 +161,9 @@ var (
 	// ================= FileTransfer part =================
 	ErrNoSpace               = newHTTPErr(noEnoughSpace, "not enough space")
 	ErrAddDownloadTaskFailed = newHTTPErr(addDownloadTaskFailed, "add download task failed")
+	ErrDownloadTaskNotExist  = newHTTPErr(downloadTaskNotExist, "download task not exist")
+	ErrDownloadTaskExist     = newHTTPErr(downloadTaskExist, "download task already queued")
+	ErrDownloadQueueFull     = newHTTPErr(downloadQueueFull, "download queue is full")
+	ErrDownloadTaskStopped   = newHTTPErr(downloadTaskStopped, "download task cancelled or manager stopped")
+	ErrDownloadTaskRunning   = newHTTPErr(downloadTaskRunning, "download task is running")
 )